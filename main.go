@@ -2,88 +2,132 @@ package main
 
 import (
 	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 
 	"github.com/charmbracelet/log"
+	"github.com/svader0/yarnball/pkg/compiler"
 	"github.com/svader0/yarnball/pkg/evaluator"
 	"github.com/svader0/yarnball/pkg/lexer"
 	"github.com/svader0/yarnball/pkg/parser"
-	"github.com/svader0/yarnball/pkg/preprocessor"
+	"github.com/svader0/yarnball/pkg/vm"
 )
 
 // TODO:
 /*
- - Make the preprocessor more robust and make it respect line numbers
+ - Make the preprocessor more robust
  - Add a program trace / debug mode
- - Implement a more robust error handling system
  - Change language spec to look more like actual crochet
- - ADD SUPPORT FOR INPUT (e.g. reading from stdin)
 */
 
+var (
+	timeout  = flag.Duration("timeout", 0, "stop a pattern after this much wall-clock time (e.g. 5s); 0 means no limit")
+	engine   = flag.String("engine", "tree", "how to run a pattern file: tree (walk the syntax tree) or vm (compile to bytecode)")
+	memory   = flag.Int("memory", evaluator.DefaultMemoryLimit, "most cells the skein (pattern memory) may hold")
+	lines    = flag.Int("lifelines", evaluator.DefaultLifelineLimit, "most cells the lifelines (checkpoints for frog) may hold between them")
+	bigInts  = flag.Bool("big", false, "use arbitrary-precision integers, which never overflow (tree engine only)")
+	cells    = flag.String("cells", "i64", "cell width: i8, i16, i32 or i64 (signed), u8, u16, u32 or u64 (unsigned) (tree engine only)")
+	overflow = flag.String("overflow", "wrap", "what a result too large for a cell does: wrap, saturate or trap (tree engine only)")
+	root     = flag.String("root", "", "directory joined patterns are read from; joins may reach anywhere inside it (default: the working directory, or the pattern's own directory if it is outside that)")
+)
+
 func main() {
-	if len(os.Args) > 1 {
-		if err := runFile(os.Args[1]); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [pattern.yarn]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	opts, err := evalOptions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	if flag.NArg() > 0 {
+		if err := runFile(flag.Arg(0), opts); err != nil {
+			var halt *evaluator.HaltError
+			if errors.As(err, &halt) {
+				os.Exit(halt.Code)
+			}
+			fmt.Fprintf(os.Stderr, "Error: %s\n", describe(err))
 			os.Exit(1)
 		}
 	} else {
-		repl()
+		repl(opts)
 	}
 }
 
-func repl() {
+func repl(opts []evaluator.Option) {
 	handler := log.New(os.Stderr)
 	logger := slog.New(handler)
-	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Println("Yarnball REPL :) — type `\\q` to quit.")
-	ev := evaluator.New(logger)
-	applyStepLimit(ev)
+	// Share one reader between the REPL and input stitches so neither
+	// swallows lines buffered by the other.
+	in := bufio.NewReader(os.Stdin)
+	fmt.Println("Yarnball REPL :) — type `.s` to show the stack, `.m` the markers, `\\q` to quit.")
+	ev := evaluator.New(logger, append(opts, evaluator.WithInput(in))...)
 
 	var inputBuilder strings.Builder
-	pre := preprocessor.New() // Create preprocessor once
+	// patterns joined at the prompt are found relative to the root
+	dir := os.DirFS(cmp.Or(*root, "."))
 
 	for {
 		fmt.Print("=> ")
-		if !scanner.Scan() {
+		line, err := in.ReadString('\n')
+		if err != nil && line == "" {
 			break
 		}
-		line := scanner.Text()
+		line = strings.TrimRight(line, "\r\n")
 		if strings.TrimSpace(line) == "\\q" {
 			break
 		}
 
 		// handle print stack command
 		if strings.TrimSpace(line) == ".s" {
-			fmt.Println("Stack:", ev.Stack(), " <-- top ")
+			printStacks(ev)
+			continue
+		}
+
+		// handle print markers command
+		if strings.TrimSpace(line) == ".m" {
+			printMarkers(ev.MarkerValues())
 			continue
 		}
 
 		// Accumulate multi-line input
 		inputBuilder.WriteString(line + "\n")
 		if isCompleteInput(inputBuilder.String()) {
-			processed, err := pre.Process(inputBuilder.String())
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Preprocessing error: %v\n", err)
-				inputBuilder.Reset()
-				continue
-			}
-
-			// lex -> parse -> eval
-			l := lexer.New(processed)
-			p := parser.New(l)
-			prog, err := p.ParseProgram()
+			// preprocess -> lex -> parse (joining patterns) -> eval
+			prog, err := parser.ParseFile(dir, "", inputBuilder.String())
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Parse error: %v\n", err)
+				fmt.Fprintf(os.Stderr, "Parse error: %s\n", describe(err))
 				inputBuilder.Reset()
 				continue
 			}
 
-			if err := ev.Eval(prog); err != nil && err.Error() != "FO: halt" {
-				fmt.Fprintf(os.Stderr, "Runtime error: %v\n", err)
+			ctx, cancel := runContext()
+			err = ev.EvalContext(ctx, prog)
+			cancel()
+			var halt *evaluator.HaltError
+			var unresolved parser.ErrorList
+			switch {
+			case err == nil:
+			case errors.As(err, &halt):
+				fmt.Printf("Finished off (status %d).\n", halt.Code)
+			case errors.As(err, &unresolved):
+				fmt.Fprintf(os.Stderr, "Resolve error: %s\n", describe(err))
+			default:
+				fmt.Fprintf(os.Stderr, "Runtime error: %s\n", describe(err))
 			}
 			inputBuilder.Reset()
 		}
@@ -91,7 +135,29 @@ func repl() {
 	fmt.Println("Goodbye.")
 }
 
-func runFile(path string) error {
+// patternRoot returns the directory the pattern at path joins other patterns
+// from, set by --root, and the pattern's slash-separated name inside it.
+func patternRoot(path string) (dir, name string, err error) {
+	dir = cmp.Or(*root, ".")
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", "", err
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", err
+	}
+	rel, err := filepath.Rel(absDir, abs)
+	if err == nil && filepath.IsLocal(rel) {
+		return dir, filepath.ToSlash(rel), nil
+	}
+	if *root != "" {
+		return "", "", fmt.Errorf("%s is outside the root %s", path, *root)
+	}
+	return filepath.Dir(path), filepath.Base(path), nil
+}
+
+func runFile(path string, opts []evaluator.Option) error {
 	handler := log.New(os.Stderr)
 	// handler.SetLevel(log.DebugLevel)
 	logger := slog.New(handler)
@@ -100,45 +166,190 @@ func runFile(path string) error {
 	if err != nil {
 		return err
 	}
-	input := string(data)
 
-	// Preprocess the input before lexing/parsing
-	pre := preprocessor.New()
-	input, err = pre.Process(input)
+	// Process the entire file as a single program, along with the patterns it
+	// joins from the root
+	dir, name, err := patternRoot(path)
 	if err != nil {
-		return fmt.Errorf("Preprocessing error: %v", err)
+		return err
 	}
-
-	// Process the entire file as a single program
-	l := lexer.New(input)
-	p := parser.New(l)
-	prog, err := p.ParseProgram()
+	prog, err := parser.ParseFile(os.DirFS(dir), name, string(data))
 	if err != nil {
-		return fmt.Errorf("Parse error: %v", err)
+		return fmt.Errorf("Parse error: %w", err)
+	}
+	// Catch undefined stitches before anything runs. Prepare and Compile
+	// each resolve prog, so only the engine that runs it gets it.
+	var run func(ctx context.Context) error
+	switch *engine {
+	case "tree":
+		ready, err := evaluator.Prepare(prog)
+		if err != nil {
+			return fmt.Errorf("Resolve error: %w", err)
+		}
+		ev := evaluator.New(logger, opts...)
+		run = func(ctx context.Context) error { return ev.Run(ctx, ready) }
+	case "vm":
+		if *bigInts || *cells != "i64" || *overflow != "wrap" {
+			return errors.New("--big, --cells and --overflow need the tree engine (--engine tree)")
+		}
+		code, err := compiler.Compile(prog)
+		if err != nil {
+			return fmt.Errorf("Compile error: %w", err)
+		}
+		m := vm.New(code, vm.WithStepLimit(stepLimit()), vm.WithMemoryLimit(*memory), vm.WithLifelineLimit(*lines))
+		run = m.Run
+	default:
+		return fmt.Errorf("unknown engine %q (want tree or vm)", *engine)
 	}
 
-	ev := evaluator.New(logger)
-	applyStepLimit(ev)
-	if err := ev.Eval(prog); err != nil && err.Error() != "FO: halt" {
-		return fmt.Errorf("Runtime error: %v", err)
+	ctx, cancel := runContext()
+	defer cancel()
+	if err := run(ctx); err != nil {
+		if errors.Is(err, evaluator.ErrHalt) {
+			return err
+		}
+		return fmt.Errorf("Runtime error: %w", err)
 	}
 	return nil
 }
 
-func applyStepLimit(ev *evaluator.Evaluator) {
+// runContext returns the context a pattern runs under, bounded by the
+// --timeout flag when one was given.
+func runContext() (context.Context, context.CancelFunc) {
+	if *timeout > 0 {
+		return context.WithTimeout(context.Background(), *timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// evalOptions returns the Evaluator options set by the command-line flags.
+func evalOptions() ([]evaluator.Option, error) {
+	opts := []evaluator.Option{evaluator.WithStepLimit(stepLimit()), evaluator.WithMemoryLimit(*memory), evaluator.WithLifelineLimit(*lines)}
+	if *bigInts {
+		if *cells != "i64" || *overflow != "wrap" {
+			return nil, errors.New("--big cannot be combined with --cells or --overflow")
+		}
+		return append(opts, evaluator.WithBigIntegers()), nil
+	}
+
+	bits, unsigned, err := parseCells(*cells)
+	if err != nil {
+		return nil, err
+	}
+	policies := map[string]evaluator.Overflow{"wrap": evaluator.Wrap, "saturate": evaluator.Saturate, "trap": evaluator.Trap}
+	policy, ok := policies[*overflow]
+	if !ok {
+		return nil, fmt.Errorf("unknown overflow policy %q (want wrap, saturate or trap)", *overflow)
+	}
+	return append(opts, evaluator.WithCells(bits, unsigned), evaluator.WithOverflow(policy)), nil
+}
+
+// parseCells parses a --cells width such as i64 or u8.
+func parseCells(s string) (bits int, unsigned bool, err error) {
+	if len(s) > 1 && (s[0] == 'i' || s[0] == 'u') {
+		switch bits, _ := strconv.Atoi(s[1:]); bits {
+		case 8, 16, 32, 64:
+			return bits, s[0] == 'u', nil
+		}
+	}
+	return 0, false, fmt.Errorf("unknown cell width %q (want i8, i16, i32, i64, u8, u16, u32 or u64)", s)
+}
+
+// stepLimit reads YARNBALL_STEP_LIMIT, returning 0 (the default limit) when unset or invalid.
+func stepLimit() int {
 	if raw := os.Getenv("YARNBALL_STEP_LIMIT"); raw != "" {
 		if limit, err := strconv.Atoi(raw); err == nil {
-			ev.SetStepLimit(limit)
+			return limit
+		}
+	}
+	return 0
+}
+
+// describe renders err, listing every error of a failed parse or compile, and
+// adding the position, stitch traceback and stack contents when it is a
+// runtime error from the evaluator.
+func describe(err error) string {
+	var list parser.ErrorList
+	if errors.As(err, &list) && len(list) > 1 {
+		var b strings.Builder
+		// keep any "Parse error: " style prefix the list was wrapped in
+		b.WriteString(strings.TrimSuffix(err.Error(), list.Error()))
+		fmt.Fprintf(&b, "%d errors", len(list))
+		for _, d := range list {
+			fmt.Fprintf(&b, "\n  %s", d)
 		}
+		return b.String()
 	}
+	var rerr evaluator.Error
+	if !errors.As(err, &rerr) {
+		return err.Error()
+	}
+	ctx := rerr.Context()
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v\n  at %s", err, ctx.Pos)
+	for i := len(ctx.Trace) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "\n  in stitch %s, called at %s", ctx.Trace[i].Stitch, ctx.Trace[i].Pos)
+	}
+	var stack any = ctx.Stack
+	if ctx.Values != nil {
+		stack = ctx.Values
+	}
+	if ctx.Color != "" {
+		fmt.Fprintf(&b, "\n  stack (color %s): %v <-- top", ctx.Color, stack)
+	} else {
+		fmt.Fprintf(&b, "\n  stack: %v <-- top", stack)
+	}
+	return b.String()
 }
 
-// Helper function to check if the input is complete
+// printStacks shows the stack being worked, or, once the pattern has used
+// other yarn colours, every colour's stack.
+func printStacks(ev *evaluator.Evaluator) {
+	stacks := ev.ColorValues()
+	if len(stacks) == 1 {
+		fmt.Println("Stack:", ev.Values(), " <-- top ")
+		return
+	}
+	fmt.Println("Stacks:")
+	for _, color := range slices.Sorted(maps.Keys(stacks)) {
+		working := ""
+		if color == ev.Color() {
+			working = " (working)"
+		}
+		fmt.Printf("  color %s%s: %v <-- top\n", color, working, stacks[color])
+	}
+}
+
+// printMarkers lists the global stitch markers, sorted by name.
+func printMarkers(markers map[string]any) {
+	if len(markers) == 0 {
+		fmt.Println("Markers: none placed")
+		return
+	}
+	fmt.Println("Markers:")
+	for _, name := range slices.Sorted(maps.Keys(markers)) {
+		fmt.Printf("  %s = %v\n", name, markers[name])
+	}
+}
+
+// Helper function to check if the input is complete. It counts tokens rather
+// than characters, so brackets inside strings and comments are ignored.
 func isCompleteInput(input string) bool {
-	openParens := strings.Count(input, "(")
-	closeParens := strings.Count(input, ")")
-	openBrackets := strings.Count(input, "[")
-	closeBrackets := strings.Count(input, "]")
-	asterisks := strings.Count(input, "*")
+	var openParens, closeParens, openBrackets, closeBrackets, asterisks int
+	l := lexer.New(input)
+	for tok := l.NextToken(); tok.Type != lexer.EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case lexer.LPAREN:
+			openParens++
+		case lexer.RPAREN:
+			closeParens++
+		case lexer.LBRACKET:
+			openBrackets++
+		case lexer.RBRACKET:
+			closeBrackets++
+		case lexer.ASTERISK:
+			asterisks++
+		}
+	}
 	return openParens == closeParens && openBrackets == closeBrackets && asterisks%2 == 0
 }
@@ -0,0 +1,193 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/svader0/yarnball/pkg/parser"
+)
+
+/*
+	The bytecode executed by the vm package. Every instruction is an opcode
+	with one integer operand, and a Program is an immutable slice of them with
+	stitch calls and control flow already resolved to instruction addresses.
+*/
+
+type Opcode byte
+
+const (
+	// Stack + arithmetic
+	OpPush Opcode = iota // ch: push Arg
+	OpPop                // sc
+	OpDup                // sl st
+	OpSwap               // swap
+	OpOver               // over
+	OpPick               // pick: Arg is the depth
+	OpRoll               // roll: Arg is the depth
+	OpInc                // inc
+	OpDec                // dec
+	OpAdd                // bob
+	OpSub                // hdc
+	OpMul                // dc
+	OpDiv                // tr
+	OpMod                // cl
+	OpRot                // turn
+	OpGt                 // >
+	OpLt                 // <
+	OpEq                 // eq
+	OpNeq                // neq
+
+	// Bitwise and logical
+	OpAnd    // weave
+	OpOr     // mesh
+	OpXor    // cross
+	OpNot    // crab
+	OpShl    // lengthen: shift second left by top bits
+	OpShr    // shorten: shift second right by top bits
+	OpLogAnd // tog
+	OpLogOr  // alt
+	OpLogNot // knot
+
+	// Literals
+	OpString // push a string literal: Arg is an index into Program.Strings
+
+	// Stitch markers; Arg is an index into Program.Markers
+	OpPlaceMarker // pm: local to the current stitch call, global at top level
+	OpPlaceGlobal // pm global
+	OpSlipMarker  // sm: the call's own marker if placed, else the global one
+	OpSlipGlobal  // sm global
+
+	// Yarn colours; Arg is an index into Program.Colors
+	OpChangeColor // change to color: work with another stack
+	OpCarry       // carry: pop here, push onto the colour's stack
+	OpPickUp      // pick up: pop from the colour's stack, push here
+
+	// Skein (addressable memory)
+	OpWind    // wind: grow the skein, push the new block's address
+	OpStash   // stash: store second at address top
+	OpUnstash // unstash: replace an address with its cell's value
+	OpMeasure // measure: push the skein's size
+
+	// Lifelines (checkpoints of the stacks, colour, global markers and skein)
+	OpLifeline // lifeline: record a checkpoint
+	OpFrog     // frog: restore the most recent checkpoint and drop it
+	OpPullOut  // pull out lifeline: drop the most recent checkpoint
+
+	// I/O
+	OpPutChar  // pic
+	OpPutInt   // yo
+	OpPutStr   // embroider
+	OpReadChar // pull up loop
+	OpReadInt  // draw through
+	OpHalt     // fo: Arg is the exit status
+
+	// Control flow
+	OpDefine      // stitch definition reached; a no-op that only counts a step
+	OpJoin        // join pattern reached; a no-op that only counts a step
+	OpCall        // Arg is an index into Program.Stitches
+	OpIf          // pop; jump to Arg if zero
+	OpRepeat      // start a repeat of Arg passes
+	OpRepeatStack // start a `repeat from stack`: pop the number of passes
+	OpBeginRepeat // start a `repeat while` or `repeat until`
+	OpLoop        // end the innermost counted repeat and jump to Arg if it has no passes left, else start the next
+	OpWhile       // peek; if zero, end the innermost repeat and jump to Arg, else start the next pass
+	OpUntil       // peek; if non-zero, end the innermost repeat and jump to Arg, else start the next pass
+	OpJump        // jump to Arg
+	OpReturn      // return from a stitch, or end the program at top level
+	OpSnip        // snip: jump to Arg, the end of the innermost repeat
+	OpSkip        // skip: jump to Arg, the loop check of the innermost repeat
+	OpTieOff      // tie off: return from the current stitch
+	OpDropLoop    // end the innermost repeat without a loop check (before leaving it early)
+	OpTally       // push the number of passes the innermost repeat has finished
+	OpTry         // start a try block whose rescue branch is at Arg
+	OpEndTry      // end the innermost try block without an error and jump to Arg, past its rescue branch
+	OpDropTry     // end the innermost try block (before leaving it early)
+	OpSnag        // snag: pop an error code and raise it
+	OpCount       // check a row's stitch count: Arg is an index into Program.Counts
+
+	numOpcodes
+)
+
+// opNames maps each opcode to the stitch it implements, as used in errors.
+var opNames = [numOpcodes]string{
+	OpPush: "ch", OpPop: "sc", OpDup: "slst", OpSwap: "swap", OpOver: "over",
+	OpPick: "pick", OpRoll: "roll", OpInc: "inc", OpDec: "dec",
+	OpAdd: "bob", OpSub: "hdc", OpMul: "dc", OpDiv: "tr", OpMod: "cl",
+	OpRot: "turn", OpGt: ">", OpLt: "<", OpEq: "eq", OpNeq: "neq", OpString: "string",
+	OpAnd: "weave", OpOr: "mesh", OpXor: "cross", OpNot: "crab", OpShl: "lengthen", OpShr: "shorten",
+	OpLogAnd: "tog", OpLogOr: "alt", OpLogNot: "knot",
+	OpPlaceMarker: "pm", OpPlaceGlobal: "pm", OpSlipMarker: "sm", OpSlipGlobal: "sm",
+	OpChangeColor: "change", OpCarry: "carry", OpPickUp: "pick up",
+	OpWind: "wind", OpStash: "stash", OpUnstash: "unstash", OpMeasure: "measure",
+	OpLifeline: "lifeline", OpFrog: "frog", OpPullOut: "pull out lifeline",
+	OpPutChar: "pic", OpPutInt: "yo", OpPutStr: "embroider", OpReadChar: "pull up loop", OpReadInt: "draw through",
+	OpHalt: "fo", OpDefine: "stitch", OpJoin: "join pattern", OpCall: "call", OpIf: "if",
+	OpRepeat: "repeat", OpRepeatStack: "repeat from stack", OpBeginRepeat: "repeat", OpLoop: "repeat",
+	OpWhile: "repeat while", OpUntil: "repeat until", OpJump: "jump", OpReturn: "return",
+	OpSnip: "snip", OpSkip: "skip", OpTieOff: "tie off", OpDropLoop: "snip", OpTally: "tally",
+	OpTry: "try", OpEndTry: "try", OpDropTry: "try", OpSnag: "snag", OpCount: "count",
+}
+
+func (op Opcode) String() string {
+	if op < numOpcodes {
+		return opNames[op]
+	}
+	return fmt.Sprintf("Opcode(%d)", op)
+}
+
+// uncounted marks the opcodes that do not take a step; see Counted.
+var uncounted = [256]bool{OpJump: true, OpReturn: true, OpDropLoop: true, OpEndTry: true, OpDropTry: true}
+
+// Counted reports whether executing op takes a step towards the step limit.
+// Exactly one counted instruction is emitted per AST node, plus the loop
+// check that starts each pass of a repeat (and ends it), which the
+// tree-walking evaluator counts too, so both enforce the same limit; the
+// other jumps the compiler adds on top are free.
+func (op Opcode) Counted() bool {
+	return !uncounted[op]
+}
+
+type Instr struct {
+	Op  Opcode
+	Arg int
+}
+
+func (in Instr) String() string {
+	return fmt.Sprintf("%-14s %d", in.Op, in.Arg)
+}
+
+// Stitch is a compiled stitch definition.
+type Stitch struct {
+	Name   string
+	Entry  int   // address of the stitch's first instruction
+	Params []int // the parameters, as indices into Program.Markers
+}
+
+// Program is compiled bytecode. It is never modified after Compile returns, so
+// one Program may be run by several vm.Machines concurrently.
+type Program struct {
+	Code     []Instr
+	Pos      []parser.Pos // source position of each instruction in Code
+	Stitches []Stitch
+	Strings  []string // string literals, in the order they were compiled
+	Markers  []string // stitch marker names
+	Colors   []string // yarn colour names; Colors[0] is parser.MainColor
+	Counts   []Count  // row stitch counts
+}
+
+// Count is the stitch count that ends a row; see parser.CountInstr.
+type Count struct {
+	Row  string
+	Want int
+}
+
+// OpName names the stitch executed by the instruction at pc, for error messages.
+func (p *Program) OpName(pc int) string {
+	in := p.Code[pc]
+	switch in.Op {
+	case OpCall:
+		return p.Stitches[in.Arg].Name
+	case OpCount:
+		return fmt.Sprintf("(%d)", p.Counts[in.Arg].Want)
+	}
+	return in.Op.String()
+}
@@ -0,0 +1,291 @@
+package compiler
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/svader0/yarnball/pkg/parser"
+)
+
+// simpleOps maps the stitches parsed as SimpleInstr to their opcodes.
+var simpleOps = map[string]Opcode{
+	"ch": OpPush, "sc": OpPop, "slst": OpDup, "swap": OpSwap, "over": OpOver,
+	"pick": OpPick, "roll": OpRoll, "inc": OpInc, "dec": OpDec,
+	"bob": OpAdd, "hdc": OpSub, "dc": OpMul, "tr": OpDiv, "cl": OpMod,
+	"turn": OpRot, ">": OpGt, "<": OpLt, "eq": OpEq, "neq": OpNeq,
+	"weave": OpAnd, "mesh": OpOr, "cross": OpXor, "crab": OpNot, "lengthen": OpShl, "shorten": OpShr,
+	"tog": OpLogAnd, "alt": OpLogOr, "knot": OpLogNot,
+	"pic": OpPutChar, "yo": OpPutInt, "pull up loop": OpReadChar, "draw through": OpReadInt,
+	"embroider": OpPutStr, "fo": OpHalt,
+	"wind": OpWind, "stash": OpStash, "unstash": OpUnstash, "measure": OpMeasure,
+	"lifeline": OpLifeline, "frog": OpFrog, "pull out lifeline": OpPullOut,
+	"tally": OpTally, "snag": OpSnag,
+}
+
+type compiler struct {
+	prog     *Program
+	stitches map[string]int // stitch name -> index into prog.Stitches
+	markers  map[string]int // marker name -> index into prog.Markers
+	colors   map[string]int // colour name -> index into prog.Colors
+	loops    []*loop        // repeats enclosing the code being compiled, innermost last
+	tries    int            // try blocks enclosing the code being compiled, in the current stitch
+	errors   parser.ErrorList
+}
+
+// loop tracks a repeat while its body is compiled, for snip and skip.
+type loop struct {
+	check int   // address skip jumps to
+	snips []int // snip jumps to patch to the end of the repeat
+	tries int   // try blocks enclosing the repeat
+}
+
+// Compile resolves prog (see parser.Resolve) and lowers it to bytecode.
+// Resolution errors and malformed arguments are reported as a parser.ErrorList.
+// Resolving changes prog, so a program already given to evaluator.Prepare
+// must not be compiled too; parse the pattern again instead.
+func Compile(prog *parser.Program) (*Program, error) {
+	if err := parser.Resolve(prog, nil); err != nil {
+		return nil, err
+	}
+	c := &compiler{prog: &Program{}, stitches: make(map[string]int), markers: make(map[string]int), colors: make(map[string]int)}
+	c.color(parser.MainColor)
+	for i, def := range prog.Stitches {
+		c.stitches[def.Name] = i
+		st := Stitch{Name: def.Name}
+		for _, param := range def.Params {
+			st.Params = append(st.Params, c.marker(param))
+		}
+		c.prog.Stitches = append(c.prog.Stitches, st)
+	}
+
+	c.block(prog.Instructions)
+	c.emit(OpReturn, 0, parser.Pos{})
+	for i, def := range prog.Stitches {
+		c.prog.Stitches[i].Entry = len(c.prog.Code)
+		c.loops, c.tries = c.loops[:0], 0
+		c.block(def.Body)
+		c.emit(OpReturn, 0, def.EndPos())
+	}
+
+	c.errors.Sort()
+	if err := c.errors.Err(); err != nil {
+		return nil, err
+	}
+	return c.prog, nil
+}
+
+func (c *compiler) block(instrs []parser.Instruction) {
+	for _, instr := range instrs {
+		c.instr(instr)
+	}
+}
+
+func (c *compiler) instr(instr parser.Instruction) {
+	switch node := instr.(type) {
+	case *parser.MarkerInstr:
+		c.markerOp(node)
+	case *parser.ColorInstr:
+		op := OpPickUp
+		switch node.Op {
+		case "change":
+			op = OpChangeColor
+		case "carry":
+			op = OpCarry
+		}
+		c.emit(op, c.color(node.Color), node.Pos())
+	case *parser.ControlInstr:
+		c.control(node)
+	case *parser.StringInstr:
+		c.emit(OpString, len(c.prog.Strings), node.Pos())
+		c.prog.Strings = append(c.prog.Strings, node.Value)
+	case *parser.SimpleInstr:
+		c.simple(node)
+	case *parser.RepeatInstr:
+		c.repeat(node)
+	case *parser.CallInstr:
+		idx, ok := c.stitches[node.Name]
+		if !ok {
+			c.errorf(node.Pos(), "undefined stitch %q", node.Name)
+			return
+		}
+		c.emit(OpCall, idx, node.Pos())
+	case *parser.StitchDef:
+		// the body is compiled after the main pattern
+		c.emit(OpDefine, 0, node.Pos())
+	case *parser.JoinInstr:
+		// so are the joined pattern's stitches
+		c.emit(OpJoin, 0, node.Pos())
+	case *parser.IfInstr:
+		jumpElse := c.emit(OpIf, 0, node.Pos())
+		c.block(node.IfBody)
+		if len(node.ElseBody) == 0 {
+			c.patch(jumpElse)
+			return
+		}
+		jumpEnd := c.emit(OpJump, 0, node.Pos())
+		c.patch(jumpElse)
+		c.block(node.ElseBody)
+		c.patch(jumpEnd)
+	case *parser.CountInstr:
+		c.emit(OpCount, len(c.prog.Counts), node.Pos())
+		c.prog.Counts = append(c.prog.Counts, Count{Row: node.Row, Want: node.Want})
+	case *parser.TryInstr:
+		rescue := c.emit(OpTry, 0, node.Pos())
+		c.tries++
+		c.block(node.Body)
+		c.tries--
+		end := c.emit(OpEndTry, 0, node.Pos())
+		c.patch(rescue)
+		c.block(node.Rescue)
+		c.patch(end)
+	default:
+		c.errorf(instr.Pos(), "unknown instruction type: %T", instr)
+	}
+}
+
+func (c *compiler) simple(si *parser.SimpleInstr) {
+	op, ok := simpleOps[si.Token]
+	if !ok {
+		c.errorf(si.Pos(), "unknown stitch %s", si.Token)
+		return
+	}
+	arg := 0
+	switch op {
+	case OpPush, OpPick, OpRoll, OpHalt:
+		if len(si.Args) == 0 {
+			if op != OpHalt {
+				c.errorf(si.Pos(), "%s: missing argument", si.Token)
+			}
+			break
+		}
+		n, err := strconv.Atoi(si.Args[0])
+		if err != nil || (n < 0 && (op == OpPick || op == OpRoll)) {
+			c.errorf(si.Pos(), "%s: invalid argument %q", si.Token, si.Args[0])
+			return
+		}
+		arg = n
+	}
+	c.emit(op, arg, si.Pos())
+}
+
+// marker returns the index of the named marker in prog.Markers, adding it if needed.
+func (c *compiler) marker(name string) int {
+	idx, ok := c.markers[name]
+	if !ok {
+		idx = len(c.prog.Markers)
+		c.markers[name] = idx
+		c.prog.Markers = append(c.prog.Markers, name)
+	}
+	return idx
+}
+
+// color returns the index of the named colour in prog.Colors, adding it if needed.
+func (c *compiler) color(name string) int {
+	idx, ok := c.colors[name]
+	if !ok {
+		idx = len(c.prog.Colors)
+		c.colors[name] = idx
+		c.prog.Colors = append(c.prog.Colors, name)
+	}
+	return idx
+}
+
+func (c *compiler) markerOp(mi *parser.MarkerInstr) {
+	var op Opcode
+	switch {
+	case mi.Op == "pm" && mi.Global:
+		op = OpPlaceGlobal
+	case mi.Op == "pm":
+		op = OpPlaceMarker
+	case mi.Global:
+		op = OpSlipGlobal
+	default:
+		op = OpSlipMarker
+	}
+	c.emit(op, c.marker(mi.Name), mi.Pos())
+}
+
+func (c *compiler) repeat(ri *parser.RepeatInstr) {
+	pos := ri.Pos()
+	var check int
+	switch ri.Mode {
+	case parser.RepeatCount, parser.RepeatStack:
+		if ri.Mode == parser.RepeatCount {
+			c.emit(OpRepeat, ri.Count, pos)
+		} else {
+			c.emit(OpRepeatStack, 0, pos)
+		}
+		check = c.emit(OpLoop, 0, pos)
+	case parser.RepeatWhile, parser.RepeatUntil:
+		op := OpWhile
+		if ri.Mode == parser.RepeatUntil {
+			op = OpUntil
+		}
+		c.emit(OpBeginRepeat, 0, pos)
+		check = c.emit(op, 0, pos)
+	default:
+		c.errorf(pos, "repeat: unknown mode")
+		return
+	}
+	l := &loop{check: check, tries: c.tries}
+	c.body(ri.Body, l)
+	c.emit(OpJump, check, pos)
+	c.patch(check)
+	for _, addr := range l.snips {
+		c.patch(addr)
+	}
+}
+
+// body compiles the body of the repeat l.
+func (c *compiler) body(instrs []parser.Instruction, l *loop) {
+	c.loops = append(c.loops, l)
+	c.block(instrs)
+	c.loops = c.loops[:len(c.loops)-1]
+}
+
+// control compiles snip, skip and tie off. Leaving a repeat early first drops
+// its loop state, as the loop check would when the repeat ends, and the try
+// blocks left with it.
+func (c *compiler) control(ci *parser.ControlInstr) {
+	pos := ci.Pos()
+	switch ci.Kind {
+	case parser.Snip, parser.Skip:
+		if len(c.loops) == 0 {
+			c.errorf(pos, "%s outside a repeat block", ci.Token)
+			return
+		}
+		l := c.loops[len(c.loops)-1]
+		for range c.tries - l.tries {
+			c.emit(OpDropTry, 0, pos)
+		}
+		if ci.Kind == parser.Skip {
+			c.emit(OpSkip, l.check, pos)
+			return
+		}
+		c.emit(OpDropLoop, 0, pos)
+		l.snips = append(l.snips, c.emit(OpSnip, 0, pos))
+	case parser.TieOff:
+		for range c.loops {
+			c.emit(OpDropLoop, 0, pos)
+		}
+		for range c.tries {
+			c.emit(OpDropTry, 0, pos)
+		}
+		c.emit(OpTieOff, 0, pos)
+	}
+}
+
+func (c *compiler) emit(op Opcode, arg int, pos parser.Pos) int {
+	c.prog.Code = append(c.prog.Code, Instr{Op: op, Arg: arg})
+	c.prog.Pos = append(c.prog.Pos, pos)
+	return len(c.prog.Code) - 1
+}
+
+// patch points the jump at addr to the next instruction to be emitted.
+func (c *compiler) patch(addr int) {
+	c.prog.Code[addr].Arg = len(c.prog.Code)
+}
+
+func (c *compiler) errorf(pos parser.Pos, format string, args ...any) {
+	c.errors = append(c.errors, &parser.Diagnostic{Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
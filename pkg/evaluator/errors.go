@@ -0,0 +1,241 @@
+package evaluator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/svader0/yarnball/pkg/parser"
+)
+
+// Frame is one stitch call that was in progress when a runtime error happened.
+type Frame struct {
+	Stitch string
+	Pos    parser.Pos // where the stitch was called
+}
+
+// RuntimeError carries the context shared by every error raised while a
+// pattern runs. Failures without a more specific type are returned as a
+// *RuntimeError wrapping Err.
+type RuntimeError struct {
+	Op    string     // the failing stitch, e.g. "tr" or "repeat while"
+	Pos   parser.Pos // where the failing stitch appears in the source
+	Stack []int      // stack contents at the time of failure, bottom first
+	Color string     // the colour whose stack that is; empty until a pattern uses colours
+	Trace []Frame    // enclosing stitch calls, outermost first
+	Err   error
+
+	// Values replaces Stack when the cells are not ints, with values typed
+	// as in Evaluator.Values.
+	Values []any
+}
+
+func (e *RuntimeError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// Context returns the shared runtime context. Every typed runtime error embeds
+// a RuntimeError, so they all satisfy Error through this method.
+func (e *RuntimeError) Context() *RuntimeError {
+	return e
+}
+
+// Error is implemented by every runtime error the evaluator returns. Use it
+// with errors.As to get at the position, stack and traceback of any failure.
+type Error interface {
+	error
+	Context() *RuntimeError
+}
+
+// StackUnderflowError reports a stitch that needed more values than the stack held.
+// For a call to a stitch with parameters, Params names them.
+type StackUnderflowError struct {
+	RuntimeError
+	Need   int
+	Have   int
+	Params []string
+}
+
+func (e *StackUnderflowError) Error() string {
+	where := ""
+	if e.Color != "" {
+		where = " on color " + e.Color
+	}
+	if len(e.Params) > 0 {
+		return fmt.Sprintf("%s: stack underflow%s (needs %d for parameters %s, has %d)", e.Op, where, e.Need, strings.Join(e.Params, " "), e.Have)
+	}
+	return fmt.Sprintf("%s: stack underflow%s (needs %d, has %d)", e.Op, where, e.Need, e.Have)
+}
+
+// DivisionByZeroError reports `tr` or `cl` with a zero divisor on top of the stack.
+type DivisionByZeroError struct {
+	RuntimeError
+}
+
+func (e *DivisionByZeroError) Error() string {
+	return fmt.Sprintf("%s: division by zero", e.Op)
+}
+
+// UndefinedStitchError reports a call to a stitch that was never defined.
+type UndefinedStitchError struct {
+	RuntimeError
+	Name string
+}
+
+func (e *UndefinedStitchError) Error() string {
+	return fmt.Sprintf("undefined stitch %q", e.Name)
+}
+
+// UndefinedMarkerError reports an sm for a marker that has not been placed.
+type UndefinedMarkerError struct {
+	RuntimeError
+	Name string
+}
+
+func (e *UndefinedMarkerError) Error() string {
+	return fmt.Sprintf("%s: marker %q has not been placed", e.Op, e.Name)
+}
+
+// AddressError reports a skein access outside the cells wound so far.
+type AddressError struct {
+	RuntimeError
+	Addr int
+	Size int
+}
+
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("%s: address %d is outside the skein (size %d)", e.Op, e.Addr, e.Size)
+}
+
+// MemoryLimitError reports a `wind` that would grow the skein past its limit.
+type MemoryLimitError struct {
+	RuntimeError
+	Want  int
+	Limit int
+}
+
+func (e *MemoryLimitError) Error() string {
+	return fmt.Sprintf("%s: cannot wind %d more cells, the skein is limited to %d", e.Op, e.Want, e.Limit)
+}
+
+// LifelineLimitError reports a lifeline that would take the cells held by all
+// lifelines past their limit (see WithLifelineLimit).
+type LifelineLimitError struct {
+	RuntimeError
+	Want     int // cells the new lifeline needs
+	Retained int // cells the lifelines already hold
+	Limit    int
+}
+
+func (e *LifelineLimitError) Error() string {
+	return fmt.Sprintf("%s: cannot keep %d more cells, lifelines are limited to %d and already hold %d", e.Op, e.Want, e.Limit, e.Retained)
+}
+
+// OverflowError reports a result that does not fit in a cell under the Trap
+// overflow policy (see WithOverflow).
+type OverflowError struct {
+	RuntimeError
+	Bits     int
+	Unsigned bool
+}
+
+func (e *OverflowError) Error() string {
+	kind := "a signed"
+	if e.Unsigned {
+		kind = "an unsigned"
+	}
+	return fmt.Sprintf("%s: integer overflow (result does not fit in %s %d-bit cell)", e.Op, kind, e.Bits)
+}
+
+// StitchCountError reports a row whose stitch count, as in `Row 3: sc 6 (12)`,
+// does not match the number of values on the stack after it.
+type StitchCountError struct {
+	RuntimeError
+	Row  string // the row's label, or "" when it has none
+	Want int
+	Have int
+}
+
+func (e *StitchCountError) Error() string {
+	row := e.Row
+	if row == "" {
+		row = fmt.Sprintf("row on line %d", e.Pos.Line)
+	}
+	stitches := "stitches"
+	if e.Want == 1 {
+		stitches = "stitch"
+	}
+	return fmt.Sprintf("%s: expected %d %s, counted %d", row, e.Want, stitches, e.Have)
+}
+
+// SnagError is raised by the snag stitch with a code chosen by the pattern.
+type SnagError struct {
+	RuntimeError
+	Code int
+}
+
+func (e *SnagError) Error() string {
+	return fmt.Sprintf("%s: error code %d", e.Op, e.Code)
+}
+
+// StepLimitError reports a pattern that ran for more steps than allowed.
+type StepLimitError struct {
+	RuntimeError
+	Limit int
+}
+
+func (e *StepLimitError) Error() string {
+	return fmt.Sprintf("step limit of %d exceeded", e.Limit)
+}
+
+// Error codes pushed by a rescue branch for the runtime errors it catches. A
+// SnagError passes on its own Code instead.
+const (
+	CodeFailed    = 1 // any runtime error without a code of its own
+	CodeUnderflow = 2
+	CodeDivision  = 3 // division by zero
+	CodeStitch    = 4 // undefined stitch
+	CodeMarker    = 5 // marker not placed
+	CodeAddress   = 6 // address outside the skein
+	CodeMemory    = 7 // skein or lifeline limit reached
+	CodeOverflow  = 8
+	CodeCount     = 9 // row stitch count does not match
+)
+
+// ErrorCode returns the code a rescue branch pushes for err. It reports false
+// for the errors a try block cannot catch: halting with `fo`, running out of
+// steps, cancellation, and anything that is not a runtime error.
+func ErrorCode(err error) (int, bool) {
+	var rt Error
+	if !errors.As(err, &rt) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return 0, false
+	}
+	switch err := rt.(type) {
+	case *SnagError:
+		return err.Code, true
+	case *StepLimitError:
+		return 0, false
+	case *StackUnderflowError:
+		return CodeUnderflow, true
+	case *DivisionByZeroError:
+		return CodeDivision, true
+	case *UndefinedStitchError:
+		return CodeStitch, true
+	case *UndefinedMarkerError:
+		return CodeMarker, true
+	case *AddressError:
+		return CodeAddress, true
+	case *MemoryLimitError, *LifelineLimitError:
+		return CodeMemory, true
+	case *OverflowError:
+		return CodeOverflow, true
+	case *StitchCountError:
+		return CodeCount, true
+	}
+	return CodeFailed, true
+}
@@ -1,30 +1,184 @@
 package evaluator
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
+	"math"
+	"math/big"
 	"os"
+	"slices"
 	"strconv"
+	"unicode/utf8"
 
 	"github.com/svader0/yarnball/pkg/parser"
 	"github.com/svader0/yarnball/pkg/stack"
 )
 
+// ErrHalt is matched (via errors.Is) by the error Eval returns when a pattern
+// finishes off with `fo`.
+var ErrHalt = errors.New("fo: halt")
+
+// HaltError unwinds Eval when a pattern executes `fo`. Code is the exit status
+// requested by the pattern (`fo 3`), or 0 when none was given.
+type HaltError struct {
+	Code int
+}
+
+func (h *HaltError) Error() string {
+	return fmt.Sprintf("fo: halt with status %d", h.Code)
+}
+
+func (h *HaltError) Is(target error) bool {
+	return target == ErrHalt
+}
+
+// Control signals travel up from snip, skip and tie off as errors until the
+// repeat or stitch call they leave absorbs them. The parser guarantees there
+// always is one, so they never reach the caller of Eval.
+var (
+	errSnip   = errors.New("snip outside a repeat")
+	errSkip   = errors.New("skip outside a repeat")
+	errTieOff = errors.New("tie off outside a stitch")
+)
+
+// ctxCheckInterval is how many steps run between checks for cancellation. It
+// is a power of two, so exec can test for it with a mask.
+const ctxCheckInterval = 1024
+
+// Evaluator is a tree-walking machine for Yarnball programs. It holds the
+// stack and all other run state, so it must not be used by more than one
+// goroutine at a time; it is cheap enough to create one per run (see Program).
 type Evaluator struct {
 	log       *slog.Logger
-	stack     *stack.Stack
-	patterns  map[string]*parser.StitchDef
+	patterns  map[string]*parser.StitchDef // stitches defined by Eval so far
+	stitches  map[string]*parser.StitchDef // stitches visible to the current run
 	stepLimit int
 	steps     int
+	out       *bufio.Writer
+	in        *bufio.Reader
+	ctx       context.Context
+	frames    []Frame  // stitch calls in progress, outermost first
+	passes    []int    // current pass of each repeat in progress, innermost last (for tally)
+	memLimit  int      // most cells the skein may hold
+	bits      int      // cell width, set by WithCells
+	unsigned  bool     // set by WithCells
+	overflow  Overflow // set by WithOverflow
+	big       bool     // set by WithBigIntegers
+	cells     runner   // the *walker for the numeric mode
+	color     string   // the yarn colour being worked
+	changed   bool     // set by the first colour stitch; errors name colours from then on
+	lineLimit int      // most cells the lifelines may hold between them
+	retained  int      // cells held by the lifelines
+}
+
+// runner is implemented by every instance of walker.
+type runner interface {
+	eval(instrs []parser.Instruction) error
+	values() []any
+	markerValues() map[string]any
+	colorValues() map[string][]any
+}
+
+// walker runs patterns for an Evaluator. It holds the state whose values
+// depend on the numeric mode: T is int by default, a narrower integer type
+// with WithCells, or *big.Int with WithBigIntegers.
+type walker[T any] struct {
+	*Evaluator
+	num     arith[T]
+	ints    *walker[int]               // this walker in the default mode, which has a fast path; nil otherwise
+	stack   *stack.Stack[T]            // the stack of the colour being worked
+	stacks  map[string]*stack.Stack[T] // every colour's stack, by name
+	scopes  []map[string]T             // markers placed by each call in frames; nil until the first pm
+	markers map[string]T               // global stitch markers
+	skein   []T                        // addressable memory, grown by `wind`
+	lines   []lifeline[T]              // checkpoints to frog back to, most recent last
+	zero    T
+	one     T
+}
+
+// lifeline is a checkpoint recorded by the lifeline stitch: everything frog
+// restores. Markers local to a stitch call are not part of it, since frog
+// does not rewind the calls in progress.
+type lifeline[T any] struct {
+	stacks  map[string][]T
+	color   string
+	markers map[string]T
+	skein   []T
+	size    int // cells held, counted against the lifeline limit
+}
+
+func newWalker[T any](e *Evaluator, num arith[T]) *walker[T] {
+	w := &walker[T]{Evaluator: e, num: num, stack: stack.New[T](), markers: make(map[string]T)}
+	w.stacks = map[string]*stack.Stack[T]{parser.MainColor: w.stack}
+	w.zero, _ = num.fromInt(0)
+	w.one, _ = num.fromInt(1)
+	return w
+}
+
+// newFixedWalker returns the walker for the cell width and overflow policy
+// set by WithCells and WithOverflow.
+func newFixedWalker(e *Evaluator) runner {
+	switch {
+	case e.bits == 64 && !e.unsigned && e.overflow == Wrap:
+		w := newWalker[int](e, ints{})
+		w.ints = w
+		return w
+	case e.bits == 8 && e.unsigned:
+		return newWalker[uint8](e, newFixed[uint8](e.bits, e.overflow))
+	case e.bits == 8:
+		return newWalker[int8](e, newFixed[int8](e.bits, e.overflow))
+	case e.bits == 16 && e.unsigned:
+		return newWalker[uint16](e, newFixed[uint16](e.bits, e.overflow))
+	case e.bits == 16:
+		return newWalker[int16](e, newFixed[int16](e.bits, e.overflow))
+	case e.bits == 32 && e.unsigned:
+		return newWalker[uint32](e, newFixed[uint32](e.bits, e.overflow))
+	case e.bits == 32:
+		return newWalker[int32](e, newFixed[int32](e.bits, e.overflow))
+	case e.unsigned:
+		return newWalker[uint64](e, newFixed[uint64](e.bits, e.overflow))
+	default:
+		return newWalker[int](e, newFixed[int](strconv.IntSize, e.overflow))
+	}
 }
 
-func New(logger *slog.Logger) *Evaluator {
-	return &Evaluator{
+// DefaultMemoryLimit is the default maximum size of the skein, in cells.
+const DefaultMemoryLimit = 1 << 20
+
+// DefaultLifelineLimit is the default number of cells the lifelines of a
+// pattern may hold between them.
+const DefaultLifelineLimit = 1 << 22
+
+// New creates an Evaluator with an empty stack. A nil logger discards logs.
+func New(logger *slog.Logger, opts ...Option) *Evaluator {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	e := &Evaluator{
 		log:       logger,
-		stack:     stack.New(),
 		patterns:  make(map[string]*parser.StitchDef),
 		stepLimit: 1_000_000,
+		memLimit:  DefaultMemoryLimit,
+		lineLimit: DefaultLifelineLimit,
+		bits:      64,
+		color:     parser.MainColor,
+		out:       bufio.NewWriter(os.Stdout),
+		in:        bufio.NewReader(os.Stdin),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if e.big {
+		e.cells = newWalker[*big.Int](e, bigs{})
+	} else {
+		e.cells = newFixedWalker(e)
 	}
+	return e
 }
 
 func (e *Evaluator) SetStepLimit(limit int) {
@@ -33,30 +187,150 @@ func (e *Evaluator) SetStepLimit(limit int) {
 	}
 }
 
-// Passes the stack to the evaluator, allowing access to it from outside
-// e.g. for debugging or inspection.
-func (e *Evaluator) Stack() *stack.Stack {
-	return e.stack
+// Passes the stack of the colour being worked to the evaluator, allowing
+// access to it from outside e.g. for debugging or inspection. It is nil unless
+// the cells are ints (see Values).
+func (e *Evaluator) Stack() *stack.Stack[int] {
+	if w, ok := e.cells.(*walker[int]); ok {
+		return w.stack
+	}
+	return nil
 }
 
+// Markers returns a copy of the global stitch markers. It is nil unless the
+// cells are ints (see MarkerValues).
+func (e *Evaluator) Markers() map[string]int {
+	if w, ok := e.cells.(*walker[int]); ok {
+		return maps.Clone(w.markers)
+	}
+	return nil
+}
+
+// Values returns a copy of the contents of the stack being worked, bottom
+// first, whatever the numeric mode. Each value has the cell type: int by default, uint8 for
+// unsigned 8-bit cells, *big.Int in big-integer mode, and so on.
+func (e *Evaluator) Values() []any {
+	return e.cells.values()
+}
+
+// MarkerValues is Markers for any numeric mode, with values as in Values.
+func (e *Evaluator) MarkerValues() map[string]any {
+	return e.cells.markerValues()
+}
+
+// Color returns the name of the yarn colour being worked. Every pattern
+// starts in parser.MainColor.
+func (e *Evaluator) Color() string {
+	return e.color
+}
+
+// ColorValues returns a copy of the stack of every colour used so far, by
+// colour name, with values as in Values.
+func (e *Evaluator) ColorValues() map[string][]any {
+	return e.cells.colorValues()
+}
+
+// Flush writes any buffered output to the underlying writer.
+func (e *Evaluator) Flush() error {
+	return e.out.Flush()
+}
+
+// Eval resolves prog (see parser.Resolve), counting stitches defined by earlier
+// calls as known, and then runs it. Undefined or duplicate stitch names are
+// returned as a parser.ErrorList before any instruction executes.
 func (e *Evaluator) Eval(prog *parser.Program) error {
-	e.log.Debug("Starting evaluation of program", "instructions", len(prog.Instructions))
+	return e.EvalContext(context.Background(), prog)
+}
+
+// EvalContext runs prog like Eval, but stops early once ctx is cancelled or its
+// deadline passes. The returned error then wraps ctx.Err(), so callers can test
+// it with errors.Is against context.Canceled or context.DeadlineExceeded.
+// Blocking reads from the input are not interrupted.
+//
+// Eval and EvalContext resolve prog in place, so a parsed program shared
+// between goroutines should go through Prepare and Run instead.
+func (e *Evaluator) EvalContext(ctx context.Context, prog *parser.Program) error {
+	if err := parser.Resolve(prog, e.hasStitch); err != nil {
+		return err
+	}
+	for _, def := range prog.Stitches {
+		e.patterns[def.Name] = def
+	}
+	return e.run(ctx, prog.Instructions, e.patterns)
+}
+
+// Run executes a prepared program on this Evaluator's stack, with the same
+// cancellation behaviour as EvalContext. Stitches defined by earlier Eval
+// calls are not visible to it, and it defines none.
+func (e *Evaluator) Run(ctx context.Context, prog *Program) error {
+	return e.run(ctx, prog.instructions, prog.stitches)
+}
+
+func (e *Evaluator) run(ctx context.Context, instrs []parser.Instruction, stitches map[string]*parser.StitchDef) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("evaluation not started: %w", err)
+	}
+	e.ctx, e.stitches = ctx, stitches
+	err := e.cells.eval(instrs)
+	e.ctx, e.stitches = nil, nil
+	if flushErr := e.Flush(); err == nil && flushErr != nil {
+		return fmt.Errorf("flushing output: %w", flushErr)
+	}
+	return err
+}
+
+func (e *walker[T]) eval(instrs []parser.Instruction) error {
+	e.log.Debug("Starting evaluation of program", "instructions", len(instrs))
 	e.steps = 0
-	for _, instr := range prog.Instructions {
+	e.frames = e.frames[:0]
+	e.scopes = e.scopes[:0]
+	e.passes = e.passes[:0]
+	for _, instr := range instrs {
 		e.log.Debug("Evaluating instruction", "instruction", instr.TokenLiteral())
 		// Execute the instruction based on its type
 		if err := e.exec(instr); err != nil {
+			var halt *HaltError
+			if errors.As(err, &halt) {
+				e.log.Debug("Pattern finished off", "status", halt.Code)
+				return halt
+			}
 			e.log.Error("Error executing instruction", "instruction", instr.TokenLiteral(), "error", err)
-			return fmt.Errorf("error executing instruction %s: %w", instr.TokenLiteral(), err)
+			return err
 		}
 		e.log.Debug("Instruction executed successfully", "instruction", instr.TokenLiteral())
 	}
 	return nil
 }
 
-func (e *Evaluator) exec(instr parser.Instruction) error {
-	if err := e.checkStep(); err != nil {
-		return err
+func (e *walker[T]) values() []any {
+	return anys(e.stack.Items())
+}
+
+func (e *walker[T]) colorValues() map[string][]any {
+	values := make(map[string][]any, len(e.stacks))
+	for color, st := range e.stacks {
+		values[color] = anys(st.Items())
+	}
+	return values
+}
+
+func (e *walker[T]) markerValues() map[string]any {
+	values := make(map[string]any, len(e.markers))
+	for name, x := range e.markers {
+		values[name] = x
+	}
+	return values
+}
+
+func (e *walker[T]) exec(instr parser.Instruction) error {
+	// checkStep by hand: the compiler does not inline it into generic code,
+	// and this runs for every instruction
+	e.steps++
+	if e.steps > e.stepLimit || e.steps&(ctxCheckInterval-1) == 0 {
+		// only name the instruction when there may be an error to report
+		if err := e.stepped(instr.TokenLiteral(), instr.Pos()); err != nil {
+			return err
+		}
 	}
 	switch node := instr.(type) {
 	case *parser.SimpleInstr:
@@ -65,379 +339,830 @@ func (e *Evaluator) exec(instr parser.Instruction) error {
 		return e.execRepeat(node)
 	case *parser.CallInstr:
 		return e.execCall(node)
-	case *parser.StitchDef:
-		e.patterns[node.Name] = node
+	case *parser.StitchDef, *parser.JoinInstr:
+		// already hoisted before the run started
 		return nil
 	case *parser.IfInstr:
 		return e.execIf(node)
+	case *parser.TryInstr:
+		return e.execTry(node)
+	case *parser.CountInstr:
+		if have := e.stack.Size(); have != node.Want {
+			return &StitchCountError{RuntimeError: e.context(node.TokenLiteral(), node.Pos()), Row: node.Row, Want: node.Want, Have: have}
+		}
+		return nil
+	case *parser.MarkerInstr:
+		return e.execMarker(node)
+	case *parser.ColorInstr:
+		return e.execColor(node)
+	case *parser.ControlInstr:
+		switch node.Kind {
+		case parser.Snip:
+			return errSnip
+		case parser.Skip:
+			return errSkip
+		default:
+			return errTieOff
+		}
+	case *parser.StringInstr:
+		// characters go on last first, so the first one is popped first
+		text := []rune(node.Value)
+		for i := len(text) - 1; i >= 0; i-- {
+			if err := e.pushInt(node.TokenLiteral(), node.Pos(), int(text[i])); err != nil {
+				return err
+			}
+		}
+		return e.pushInt(node.TokenLiteral(), node.Pos(), len(text))
 	default:
 		return fmt.Errorf("unknown instruction type: %T", instr)
 	}
 }
 
-func (e *Evaluator) execCall(ci *parser.CallInstr) error {
+func (e *walker[T]) execCall(ci *parser.CallInstr) error {
 	e.log.Debug("Using stitch", "name", ci.Name)
-	pat, exists := e.patterns[ci.Name]
+	pat, exists := e.stitches[ci.Name]
 	if !exists {
-		return fmt.Errorf("undefined stitch %q", ci.Name)
+		return &UndefinedStitchError{RuntimeError: e.context(ci.Name, ci.Pos()), Name: ci.Name}
 	}
 
+	// bind the parameters, the last one from the top of the stack
+	var scope map[string]T
+	if n := len(pat.Params); n > 0 {
+		if e.stack.Size() < n {
+			return &StackUnderflowError{RuntimeError: e.context(ci.Name, ci.Pos()), Need: n, Have: e.stack.Size(), Params: pat.Params}
+		}
+		scope = make(map[string]T, n)
+		for i := n - 1; i >= 0; i-- {
+			scope[pat.Params[i]], _ = e.stack.Pop()
+		}
+	}
+
+	e.frames = append(e.frames, Frame{Stitch: ci.Name, Pos: ci.Pos()})
+	e.scopes = append(e.scopes, scope)
+	defer func() {
+		e.frames = e.frames[:len(e.frames)-1]
+		e.scopes = e.scopes[:len(e.scopes)-1]
+	}()
 	for _, instr := range pat.Body {
-		if err := e.exec(instr); err != nil {
-			return fmt.Errorf("error executing stitch %s: %w", ci.Name, err)
+		if err := e.exec(instr); err == errTieOff {
+			return nil
+		} else if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (e *Evaluator) execIf(ii *parser.IfInstr) error {
+// hasStitch reports whether a stitch was defined by an earlier Eval.
+func (e *Evaluator) hasStitch(name string) bool {
+	_, ok := e.patterns[name]
+	return ok
+}
+
+// execMarker places or slips a stitch marker. Inside a stitch call, pm places
+// a marker local to that call and sm looks there before the global markers.
+func (e *walker[T]) execMarker(mi *parser.MarkerInstr) error {
+	local := !mi.Global && len(e.scopes) > 0
+	if mi.Op == "pm" {
+		n, err := e.stack.Pop()
+		if err != nil {
+			return e.underflow(mi.Op, mi.Pos(), 1)
+		}
+		if !local {
+			e.markers[mi.Name] = n
+			return nil
+		}
+		top := len(e.scopes) - 1
+		if e.scopes[top] == nil {
+			e.scopes[top] = make(map[string]T)
+		}
+		e.scopes[top][mi.Name] = n
+		return nil
+	}
+
+	if local {
+		if n, ok := e.scopes[len(e.scopes)-1][mi.Name]; ok {
+			e.stack.Push(n)
+			return nil
+		}
+	}
+	n, ok := e.markers[mi.Name]
+	if !ok {
+		return &UndefinedMarkerError{RuntimeError: e.context(mi.Op, mi.Pos()), Name: mi.Name}
+	}
+	e.stack.Push(n)
+	return nil
+}
+
+// execColor changes to another colour's stack, or moves the top value between
+// the stack being worked and another colour's.
+func (e *walker[T]) execColor(ci *parser.ColorInstr) error {
+	e.changed = true
+	other, ok := e.stacks[ci.Color]
+	if !ok {
+		other = stack.New[T]()
+		e.stacks[ci.Color] = other
+	}
+	switch ci.Op {
+	case "change":
+		e.color, e.stack = ci.Color, other
+	case "carry":
+		x, err := e.stack.Pop()
+		if err != nil {
+			return e.underflow(ci.Op, ci.Pos(), 1)
+		}
+		other.Push(x)
+	default: // "pick up"
+		x, err := other.Pop()
+		if err != nil {
+			// the other colour ran out, so the error shows its stack
+			rt := e.context(ci.Op, ci.Pos())
+			rt.Color, rt.Stack, rt.Values = ci.Color, nil, nil
+			return &StackUnderflowError{RuntimeError: rt, Need: 1, Have: 0}
+		}
+		e.stack.Push(x)
+	}
+	return nil
+}
+
+func (e *walker[T]) execIf(ii *parser.IfInstr) error {
 	cond, err := e.stack.Pop()
 	if err != nil {
-		return fmt.Errorf("if: stack underflow")
+		return e.underflow("if", ii.Pos(), 1)
 	}
-	if cond != 0 {
-		for _, instr := range ii.IfBody {
-			if err := e.exec(instr); err != nil {
-				return fmt.Errorf("error executing if body: %w", err)
-			}
-		}
-	} else {
-		for _, instr := range ii.ElseBody {
-			if err := e.exec(instr); err != nil {
-				return fmt.Errorf("error executing else body: %w", err)
-			}
+	if e.num.sign(cond) != 0 {
+		return e.block(ii.IfBody)
+	}
+	return e.block(ii.ElseBody)
+}
+
+// execTry runs the body of a try block. If a runtime error stops it, the calls
+// and repeats it left have already unwound; the error's code goes on the stack
+// and the rescue branch runs.
+func (e *walker[T]) execTry(ti *parser.TryInstr) error {
+	err := e.block(ti.Body)
+	code, ok := ErrorCode(err)
+	if !ok {
+		return err
+	}
+	e.log.Debug("Rescued runtime error", "code", code, "error", err)
+	if err := e.pushInt("rescue", ti.Pos(), code); err != nil {
+		return err
+	}
+	return e.block(ti.Rescue)
+}
+
+// block runs instrs in order, stopping at the first error.
+func (e *walker[T]) block(instrs []parser.Instruction) error {
+	for _, instr := range instrs {
+		if err := e.exec(instr); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (e *Evaluator) execSimple(si *parser.SimpleInstr) error {
+func (e *walker[T]) execSimple(si *parser.SimpleInstr) error {
 	switch si.Token {
 	case "ch":
 		n, err := strconv.Atoi(si.Args[0])
 		if err != nil {
-			return fmt.Errorf("ch: invalid argument %q: %w", si.Args[0], err)
+			return e.fail(si.Token, si.Pos(), fmt.Errorf("invalid argument %q", si.Args[0]))
 		}
-		e.stack.Push(n)
+		if e.ints != nil {
+			e.ints.stack.Push(n)
+			return nil
+		}
+		return e.pushInt(si.Token, si.Pos(), n)
 	case "pic":
-		n, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("pic: %w", err)
+		if err := e.need(si, 1); err != nil {
+			return err
 		}
-		fmt.Printf("%c", n)
+		n, _ := e.stack.Pop()
+		fmt.Fprintf(e.out, "%c", e.char(n))
 	case "yo":
-		n, err := e.stack.Pop()
+		if err := e.need(si, 1); err != nil {
+			return err
+		}
+		n, _ := e.stack.Pop()
+		fmt.Fprintln(e.out, n)
+	case "embroider":
+		// pop a length, then that many characters, and print them
+		if err := e.need(si, 1); err != nil {
+			return err
+		}
+		top, _ := e.stack.Peek()
+		n, err := e.small(si.Token, si.Pos(), top)
 		if err != nil {
-			return fmt.Errorf("yo: %w", err)
+			return err
 		}
-		fmt.Println(n)
-	case "fo":
-		os.Exit(0)
-	case "sc":
-		// pop top value
-		if e.stack.IsEmpty() {
-			return fmt.Errorf("sc: stack underflow")
+		if n < 0 {
+			return e.fail(si.Token, si.Pos(), fmt.Errorf("negative string length %d", n))
+		}
+		if n >= e.stack.Size() {
+			return e.underflow(si.Token, si.Pos(), n+1)
 		}
 		_, _ = e.stack.Pop()
-	case "dc":
-		// product of top two values
-		if e.stack.Size() < 2 {
-			return fmt.Errorf("dc: stack underflow")
+		for ; n > 0; n-- {
+			c, _ := e.stack.Pop()
+			fmt.Fprintf(e.out, "%c", e.char(c))
 		}
-		top, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("dc: %w", err)
+	case "wind":
+		// grow the skein by n zeroed cells and push the address of the first
+		if err := e.need(si, 1); err != nil {
+			return err
 		}
-		second, err := e.stack.Pop()
+		top, _ := e.stack.Pop()
+		n, err := e.small(si.Token, si.Pos(), top)
 		if err != nil {
-			return fmt.Errorf("dc: %w", err)
+			return err
 		}
-		new := top * second
-		e.stack.Push(new) // push product
-	case "bob":
-		// add top two values
-		if e.stack.Size() < 2 {
-			return fmt.Errorf("bob: stack underflow")
+		if n < 0 {
+			return e.fail(si.Token, si.Pos(), fmt.Errorf("cannot wind a negative number of cells (%d)", n))
 		}
-		top, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("bob: %w", err)
+		if n > e.memLimit-len(e.skein) {
+			return &MemoryLimitError{RuntimeError: e.context(si.Token, si.Pos()), Want: n, Limit: e.memLimit}
 		}
-		second, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("bob: %w", err)
+		if err := e.pushInt(si.Token, si.Pos(), len(e.skein)); err != nil {
+			return err
 		}
-		new := top + second
-		e.stack.Push(new)
-	case "hdc":
-		// subtract top two values
-		if e.stack.Size() < 2 {
-			return fmt.Errorf("hdc: stack underflow")
+		for ; n > 0; n-- {
+			e.skein = append(e.skein, e.zero)
 		}
-		top, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("hdc: %w", err)
+	case "stash":
+		// store second at address top
+		if err := e.need(si, 2); err != nil {
+			return err
 		}
-		second, err := e.stack.Pop()
+		top, _ := e.stack.Pop()
+		addr, err := e.address(si, top)
 		if err != nil {
-			return fmt.Errorf("hdc: %w", err)
+			return err
 		}
-		new := second - top
-		e.stack.Push(new)
-	case "tr":
-		// divide top two values
-		if e.stack.Size() < 2 {
-			return fmt.Errorf("tr: stack underflow")
+		e.skein[addr], _ = e.stack.Pop()
+	case "unstash":
+		// replace an address with the value stored there
+		if err := e.need(si, 1); err != nil {
+			return err
 		}
+		top, _ := e.stack.Pop()
+		addr, err := e.address(si, top)
+		if err != nil {
+			return err
+		}
+		e.stack.Push(e.skein[addr])
+	case "measure":
+		return e.pushInt(si.Token, si.Pos(), len(e.skein))
+	case "tally":
+		// passes the innermost repeat has finished before this one
+		return e.pushInt(si.Token, si.Pos(), e.passes[len(e.passes)-1])
+	case "snag":
 		top, err := e.stack.Pop()
 		if err != nil {
-			return fmt.Errorf("tr: %w", err)
+			return e.underflow(si.Token, si.Pos(), 1)
 		}
-		second, err := e.stack.Pop()
+		code, err := e.small(si.Token, si.Pos(), top)
 		if err != nil {
-			return fmt.Errorf("tr: %w", err)
+			return err
+		}
+		return &SnagError{RuntimeError: e.context(si.Token, si.Pos()), Code: code}
+	case "lifeline":
+		return e.lifeline(si)
+	case "frog":
+		if len(e.lines) == 0 {
+			return e.fail(si.Token, si.Pos(), fmt.Errorf("no lifeline to frog back to"))
+		}
+		e.frog(e.pullOut())
+	case "pull out lifeline":
+		if len(e.lines) == 0 {
+			return e.fail(si.Token, si.Pos(), fmt.Errorf("no lifeline to pull out"))
+		}
+		e.pullOut()
+	case "pull up loop":
+		// read one character; -1 at end of input
+		if err := e.Flush(); err != nil {
+			return e.fail(si.Token, si.Pos(), err)
+		}
+		r, _, err := e.in.ReadRune()
+		if err == io.EOF {
+			return e.pushInt(si.Token, si.Pos(), -1)
 		}
-		if top == 0 {
-			return fmt.Errorf("tr: division by zero")
+		if err != nil {
+			return e.fail(si.Token, si.Pos(), err)
+		}
+		return e.pushInt(si.Token, si.Pos(), int(r))
+	case "draw through":
+		// read one whitespace-separated integer; -1 at end of input
+		if err := e.Flush(); err != nil {
+			return e.fail(si.Token, si.Pos(), err)
+		}
+		n, err := e.num.scan(e.in)
+		if err == io.EOF {
+			return e.pushInt(si.Token, si.Pos(), -1)
+		} else if err == errOverflow {
+			return e.overflowError(si.Token, si.Pos())
+		} else if err != nil {
+			return e.fail(si.Token, si.Pos(), fmt.Errorf("invalid number: %w", err))
 		}
-		new := second / top
-		e.stack.Push(new)
-	case "cl":
-		// modulo top two values
-		if e.stack.Size() < 2 {
-			return fmt.Errorf("cl: stack underflow")
+		e.stack.Push(n)
+	case "fo":
+		code := 0
+		if len(si.Args) == 1 {
+			n, err := strconv.Atoi(si.Args[0])
+			if err != nil {
+				return e.fail(si.Token, si.Pos(), fmt.Errorf("invalid status %q", si.Args[0]))
+			}
+			code = n
 		}
-		top, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("cl: %w", err)
+		return &HaltError{Code: code}
+	case "sc":
+		// pop top value
+		if err := e.need(si, 1); err != nil {
+			return err
 		}
-		second, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("cl: %w", err)
+		_, _ = e.stack.Pop()
+	case "dc":
+		// product of top two values
+		if e.ints != nil && intBinary(e.ints.stack, intMul) {
+			return nil
 		}
-		if top == 0 {
-			return fmt.Errorf("cl: division by zero")
+		return e.binary(si, e.num.mul)
+	case "bob":
+		// add top two values
+		if e.ints != nil && intBinary(e.ints.stack, intAdd) {
+			return nil
+		}
+		return e.binary(si, e.num.add)
+	case "hdc":
+		// subtract top two values
+		if e.ints != nil && intBinary(e.ints.stack, intSub) {
+			return nil
 		}
-		new := second % top
-		e.stack.Push(new)
+		return e.binary(si, e.num.sub)
+	case "tr":
+		// divide top two values
+		if e.ints != nil && intBinary(e.ints.stack, intQuo) {
+			return nil
+		}
+		if err := e.divisor(si); err != nil {
+			return err
+		}
+		return e.binary(si, e.num.quo)
+	case "cl":
+		// modulo top two values
+		if e.ints != nil && intBinary(e.ints.stack, intRem) {
+			return nil
+		}
+		if err := e.divisor(si); err != nil {
+			return err
+		}
+		return e.binary(si, e.num.rem)
 	case "slst":
-		if e.stack.IsEmpty() {
-			return fmt.Errorf("slst: stack underflow")
+		if err := e.need(si, 1); err != nil {
+			return err
 		}
-
 		top, _ := e.stack.Peek()
 		e.stack.Push(top)
 	case "swap":
-		if e.stack.Size() < 2 {
-			return fmt.Errorf("swap: stack underflow")
-		}
-		a, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("swap: %w", err)
-		}
-		b, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("swap: %w", err)
+		if err := e.need(si, 2); err != nil {
+			return err
 		}
+		a, _ := e.stack.Pop()
+		b, _ := e.stack.Pop()
 		e.stack.Push(a)
 		e.stack.Push(b)
 	case "inc":
-		if e.stack.IsEmpty() {
-			return fmt.Errorf("inc: stack underflow")
-		}
-		top, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("inc: %w", err)
+		// increment top element
+		if e.ints != nil && intAddTop(e.ints.stack, 1) {
+			return nil
 		}
-		top++
-		e.stack.Push(top) // increment top element
+		return e.unary(si, func(top T) (T, bool) { return e.num.add(top, e.one) })
 	case "dec":
-		if e.stack.IsEmpty() {
-			return fmt.Errorf("dec: stack underflow")
-		}
-		top, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("dec: %w", err)
-		}
-		top--
-		e.stack.Push(top) // decrement top element
+		// decrement top element
+		if e.ints != nil && intAddTop(e.ints.stack, -1) {
+			return nil
+		}
+		return e.unary(si, func(top T) (T, bool) { return e.num.sub(top, e.one) })
+	case "weave":
+		if e.ints != nil && intBinary(e.ints.stack, intAnd) {
+			return nil
+		}
+		return e.binary(si, e.num.and)
+	case "mesh":
+		if e.ints != nil && intBinary(e.ints.stack, intOr) {
+			return nil
+		}
+		return e.binary(si, e.num.or)
+	case "cross":
+		if e.ints != nil && intBinary(e.ints.stack, intXor) {
+			return nil
+		}
+		return e.binary(si, e.num.xor)
+	case "crab":
+		return e.unary(si, e.num.not)
+	case "lengthen", "shorten":
+		return e.shift(si)
+	case "tog":
+		return e.binary(si, func(second, top T) (T, bool) {
+			return e.truth(e.num.sign(second) != 0 && e.num.sign(top) != 0), true
+		})
+	case "alt":
+		return e.binary(si, func(second, top T) (T, bool) {
+			return e.truth(e.num.sign(second) != 0 || e.num.sign(top) != 0), true
+		})
+	case "knot":
+		return e.unary(si, func(top T) (T, bool) { return e.truth(e.num.sign(top) == 0), true })
 	case ">":
-		if e.stack.Size() < 2 {
-			return fmt.Errorf("gt: stack underflow")
-		}
-		top, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("gt: %w", err)
-		}
-		second, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("gt: %w", err)
-		}
-		if second > top {
-			e.stack.Push(1) // push true
-		} else {
-			e.stack.Push(0) // push false
+		if e.ints != nil && intBinary(e.ints.stack, intGreater) {
+			return nil
 		}
+		return e.compare(si, func(c int) bool { return c > 0 })
 	case "<":
-		if e.stack.Size() < 2 {
-			return fmt.Errorf("lt: stack underflow")
-		}
-		top, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("lt: %w", err)
-		}
-		second, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("lt: %w", err)
-		}
-		if second < top {
-			e.stack.Push(1) // push true
-		} else {
-			e.stack.Push(0) // push false
+		if e.ints != nil && intBinary(e.ints.stack, intLess) {
+			return nil
 		}
+		return e.compare(si, func(c int) bool { return c < 0 })
 	case "eq":
-		if e.stack.Size() < 2 {
-			return fmt.Errorf("eq: stack underflow")
-		}
-		top, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("eq: %w", err)
-		}
-		second, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("eq: %w", err)
-		}
-		if second == top {
-			e.stack.Push(1) // push true
-		} else {
-			e.stack.Push(0) // push false
+		if e.ints != nil && intBinary(e.ints.stack, intEq) {
+			return nil
 		}
+		return e.compare(si, func(c int) bool { return c == 0 })
 	case "neq":
-		if e.stack.Size() < 2 {
-			return fmt.Errorf("neq: stack underflow")
-		}
-		top, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("neq: %w", err)
-		}
-		second, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("neq: %w", err)
-		}
-		if second != top {
-			e.stack.Push(1) // push true
-		} else {
-			e.stack.Push(0) // push false
+		if e.ints != nil && intBinary(e.ints.stack, intNeq) {
+			return nil
 		}
+		return e.compare(si, func(c int) bool { return c != 0 })
 	case "turn":
 		// Same function as 'rot' in FORTH ( n1 n2 n3 — n2 n3 n1 )
-		if e.stack.Size() < 3 {
-			return fmt.Errorf("turn: stack underflow")
-		}
-		top, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("turn: %w", err)
-		}
-		second, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("turn: %w", err)
-		}
-		third, err := e.stack.Pop()
-		if err != nil {
-			return fmt.Errorf("turn: %w", err)
+		if err := e.need(si, 3); err != nil {
+			return err
 		}
+		top, _ := e.stack.Pop()
+		second, _ := e.stack.Pop()
+		third, _ := e.stack.Pop()
 		e.stack.Push(second)
 		e.stack.Push(top)
 		e.stack.Push(third)
 	case "over":
-		if e.stack.Size() < 2 {
-			return fmt.Errorf("over: stack underflow")
-		}
-		val, err := e.stack.PeekAt(1)
-		if err != nil {
-			return fmt.Errorf("over: %w", err)
+		if err := e.need(si, 2); err != nil {
+			return err
 		}
+		val, _ := e.stack.PeekAt(1)
 		e.stack.Push(val)
 	case "pick":
-		if len(si.Args) != 1 {
-			return fmt.Errorf("pick: missing depth argument")
-		}
-		depth, err := strconv.Atoi(si.Args[0])
-		if err != nil || depth < 0 {
-			return fmt.Errorf("pick: invalid depth %q", si.Args[0])
+		depth, err := e.depthArg(si)
+		if err != nil {
+			return err
 		}
 		val, err := e.stack.PeekAt(depth)
 		if err != nil {
-			return fmt.Errorf("pick: %w", err)
+			return e.underflow(si.Token, si.Pos(), min(depth, math.MaxInt-1)+1)
 		}
 		e.stack.Push(val)
 	case "roll":
-		if len(si.Args) != 1 {
-			return fmt.Errorf("roll: missing depth argument")
-		}
-		depth, err := strconv.Atoi(si.Args[0])
-		if err != nil || depth < 0 {
-			return fmt.Errorf("roll: invalid depth %q", si.Args[0])
+		depth, err := e.depthArg(si)
+		if err != nil {
+			return err
 		}
 		if err := e.stack.Roll(depth); err != nil {
-			return fmt.Errorf("roll: %w", err)
+			return e.underflow(si.Token, si.Pos(), min(depth, math.MaxInt-1)+1)
 		}
 	default:
-		return fmt.Errorf("unknown stitch %s", si.Token)
+		return e.fail(si.Token, si.Pos(), fmt.Errorf("unknown stitch"))
+	}
+	return nil
+}
+
+// lifeline records a checkpoint of every colour's stack, the colour being
+// worked, the global markers and the skein.
+func (e *walker[T]) lifeline(si *parser.SimpleInstr) error {
+	size := len(e.markers) + len(e.skein)
+	for _, st := range e.stacks {
+		size += st.Size()
+	}
+	if size > e.lineLimit-e.retained {
+		return &LifelineLimitError{RuntimeError: e.context(si.Token, si.Pos()), Want: size, Retained: e.retained, Limit: e.lineLimit}
+	}
+	l := lifeline[T]{
+		stacks:  make(map[string][]T, len(e.stacks)),
+		color:   e.color,
+		markers: maps.Clone(e.markers),
+		skein:   slices.Clone(e.skein),
+		size:    size,
+	}
+	for color, st := range e.stacks {
+		l.stacks[color] = st.Items()
 	}
+	e.lines = append(e.lines, l)
+	e.retained += size
 	return nil
 }
 
-func (e *Evaluator) execRepeat(ri *parser.RepeatInstr) error {
+// pullOut removes the most recent lifeline and returns it.
+func (e *walker[T]) pullOut() lifeline[T] {
+	l := e.lines[len(e.lines)-1]
+	e.lines = e.lines[:len(e.lines)-1]
+	e.retained -= l.size
+	return l
+}
+
+// frog restores the state l recorded. Colours first used since then are
+// dropped again.
+func (e *walker[T]) frog(l lifeline[T]) {
+	for color, st := range e.stacks {
+		if items, ok := l.stacks[color]; ok {
+			st.Set(items)
+		} else {
+			delete(e.stacks, color)
+		}
+	}
+	e.color, e.stack = l.color, e.stacks[l.color]
+	e.markers, e.skein = l.markers, l.skein
+}
+
+func (e *walker[T]) execRepeat(ri *parser.RepeatInstr) error {
+	count := ri.Count // -1 for a repeat that runs until its condition stops it
+	op := "repeat"
 	switch ri.Mode {
 	case parser.RepeatCount:
-		for i := 0; i < ri.Count; i++ {
-			for _, instr := range ri.Body {
-				if err := e.exec(instr); err != nil {
-					return err
-				}
-			}
+	case parser.RepeatStack:
+		op = "repeat from stack"
+		top, err := e.stack.Pop()
+		if err != nil {
+			return e.underflow(op, ri.Pos(), 1)
 		}
-	case parser.RepeatUntil:
-		for {
-			cond, ok := e.stack.Peek()
-			if !ok {
-				return fmt.Errorf("repeat until: stack underflow")
-			}
-			if cond != 0 {
-				break
-			}
-			for _, instr := range ri.Body {
-				if err := e.exec(instr); err != nil {
-					return err
-				}
-			}
+		n, err := e.small(op, ri.Pos(), top)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return e.fail(op, ri.Pos(), fmt.Errorf("negative repeat count %d", n))
 		}
+		count = n
 	case parser.RepeatWhile:
-		for {
+		op, count = "repeat while", -1
+	case parser.RepeatUntil:
+		op, count = "repeat until", -1
+	default:
+		return e.fail(op, ri.Pos(), fmt.Errorf("unknown mode"))
+	}
+
+	check := op // the vm names its pass check after the kind of loop
+	if count >= 0 {
+		check = "repeat"
+	}
+	e.passes = append(e.passes, 0)
+	defer func() { e.passes = e.passes[:len(e.passes)-1] }()
+	for i := 0; ; i++ {
+		// Deciding whether to run another pass takes a step, so a repeat
+		// with an empty body still meets the step limit and the timeout.
+		if err := e.step(check, ri.Pos()); err != nil {
+			return err
+		}
+		if count >= 0 && i >= count {
+			return nil
+		}
+		if count < 0 {
 			cond, ok := e.stack.Peek()
 			if !ok {
-				return fmt.Errorf("repeat while: stack underflow")
-			}
-			if cond == 0 {
-				break
+				return e.underflow(op, ri.Pos(), 1)
 			}
-			for _, instr := range ri.Body {
-				if err := e.exec(instr); err != nil {
-					return err
-				}
+			// while stops on zero, until on anything else
+			if (e.num.sign(cond) == 0) == (ri.Mode == parser.RepeatWhile) {
+				return nil
 			}
 		}
-	default:
-		return fmt.Errorf("repeat: unknown mode")
+		e.passes[len(e.passes)-1] = i
+		if done, err := e.pass(ri.Body); done || err != nil {
+			return err
+		}
 	}
-	return nil
 }
 
-func (e *Evaluator) checkStep() error {
+// pass runs the body of a repeat once. A skip ends the pass early; a snip
+// ends it and reports that the whole repeat is done.
+func (e *walker[T]) pass(body []parser.Instruction) (done bool, err error) {
+	for _, instr := range body {
+		switch err := e.exec(instr); err {
+		case nil:
+		case errSkip:
+			return false, nil
+		case errSnip:
+			return true, nil
+		default:
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// step takes a step for op at pos.
+func (e *walker[T]) step(op string, pos parser.Pos) error {
 	e.steps++
+	return e.stepped(op, pos)
+}
+
+// stepped checks the step just taken, for op at pos, against the step limit
+// and the context.
+func (e *walker[T]) stepped(op string, pos parser.Pos) error {
 	if e.stepLimit > 0 && e.steps > e.stepLimit {
-		return fmt.Errorf("step limit exceeded")
+		return &StepLimitError{RuntimeError: e.context(op, pos), Limit: e.stepLimit}
+	}
+	if e.ctx != nil && e.steps%ctxCheckInterval == 0 {
+		select {
+		case <-e.ctx.Done():
+			err := fmt.Errorf("evaluation stopped after %d steps: %w", e.steps, e.ctx.Err())
+			return e.fail(op, pos, err)
+		default:
+		}
+	}
+	return nil
+}
+
+// context captures the evaluator state for an error raised by op at pos.
+func (e *walker[T]) context(op string, pos parser.Pos) RuntimeError {
+	rt := RuntimeError{Op: op, Pos: pos, Trace: slices.Clone(e.frames)}
+	if items, ok := any(e.stack.Items()).([]int); ok {
+		rt.Stack = items
+	} else {
+		rt.Values = e.values()
+	}
+	if e.changed {
+		rt.Color = e.color
+	}
+	return rt
+}
+
+// fail wraps err in a *RuntimeError raised by op at pos.
+func (e *walker[T]) fail(op string, pos parser.Pos, err error) error {
+	rt := e.context(op, pos)
+	rt.Err = err
+	return &rt
+}
+
+func (e *walker[T]) underflow(op string, pos parser.Pos, need int) error {
+	return &StackUnderflowError{RuntimeError: e.context(op, pos), Need: need, Have: e.stack.Size()}
+}
+
+// address checks that x is the address of a cell of the skein and returns it.
+// The address has already been popped, so the error shows the stack without it.
+func (e *walker[T]) address(si *parser.SimpleInstr, x T) (int, error) {
+	addr, err := e.small(si.Token, si.Pos(), x)
+	if err != nil {
+		return 0, err
+	}
+	if addr < 0 || addr >= len(e.skein) {
+		return 0, &AddressError{RuntimeError: e.context(si.Token, si.Pos()), Addr: addr, Size: len(e.skein)}
+	}
+	return addr, nil
+}
+
+// small converts x, about to be used as a count, length or address, to an
+// int. Only a big integer can be too large for one.
+func (e *walker[T]) small(op string, pos parser.Pos, x T) (int, error) {
+	n, ok := e.num.toInt(x)
+	if !ok {
+		return 0, e.fail(op, pos, fmt.Errorf("%v does not fit in %d bits", x, strconv.IntSize))
+	}
+	return n, nil
+}
+
+// char returns the character `pic` prints for x: U+FFFD when x is not a
+// valid code point.
+func (e *walker[T]) char(x T) rune {
+	n, ok := e.num.toInt(x)
+	if !ok || !utf8.ValidRune(rune(n)) || int(rune(n)) != n {
+		return utf8.RuneError
+	}
+	return rune(n)
+}
+
+// pushInt pushes n as a cell. Under the Trap policy, an n that does not fit
+// is an OverflowError raised by op at pos.
+func (e *walker[T]) pushInt(op string, pos parser.Pos, n int) error {
+	x, ok := e.num.fromInt(n)
+	if !ok {
+		return e.overflowError(op, pos)
+	}
+	e.stack.Push(x)
+	return nil
+}
+
+func (e *walker[T]) overflowError(op string, pos parser.Pos) error {
+	return &OverflowError{RuntimeError: e.context(op, pos), Bits: e.bits, Unsigned: e.unsigned}
+}
+
+// need returns a StackUnderflowError unless the stack holds at least n values.
+func (e *walker[T]) need(si *parser.SimpleInstr, n int) error {
+	if e.stack.Size() < n {
+		return e.underflow(si.Token, si.Pos(), n)
 	}
 	return nil
 }
+
+// divisor returns a DivisionByZeroError if the top of the stack is zero.
+func (e *walker[T]) divisor(si *parser.SimpleInstr) error {
+	if err := e.need(si, 2); err != nil {
+		return err
+	}
+	if top, _ := e.stack.Peek(); e.num.sign(top) == 0 {
+		return &DivisionByZeroError{RuntimeError: e.context(si.Token, si.Pos())}
+	}
+	return nil
+}
+
+// unary replaces the top of the stack with f(top). When f reports an overflow
+// the stack is left as it was.
+func (e *walker[T]) unary(si *parser.SimpleInstr, f func(top T) (T, bool)) error {
+	if err := e.need(si, 1); err != nil {
+		return err
+	}
+	top, _ := e.stack.Peek()
+	x, ok := f(top)
+	if !ok {
+		return e.overflowError(si.Token, si.Pos())
+	}
+	_, _ = e.stack.Pop()
+	e.stack.Push(x)
+	return nil
+}
+
+// binary pops the top two values and pushes f(second, top). When f reports
+// an overflow the stack is left as it was.
+func (e *walker[T]) binary(si *parser.SimpleInstr, f func(second, top T) (T, bool)) error {
+	if err := e.need(si, 2); err != nil {
+		return err
+	}
+	top, _ := e.stack.Peek()
+	second, _ := e.stack.PeekAt(1)
+	x, ok := f(second, top)
+	if !ok {
+		return e.overflowError(si.Token, si.Pos())
+	}
+	_, _ = e.stack.Pop()
+	_, _ = e.stack.Pop()
+	e.stack.Push(x)
+	return nil
+}
+
+// compare pops the top two values and pushes 1 if holds(cmp(second, top)),
+// and 0 otherwise.
+func (e *walker[T]) compare(si *parser.SimpleInstr, holds func(c int) bool) error {
+	return e.binary(si, func(second, top T) (T, bool) {
+		return e.truth(holds(e.num.cmp(second, top))), true
+	})
+}
+
+// shift pops a bit count and shifts the value under it: left for lengthen,
+// right for shorten.
+func (e *walker[T]) shift(si *parser.SimpleInstr) error {
+	if err := e.need(si, 2); err != nil {
+		return err
+	}
+	top, _ := e.stack.Peek()
+	n, err := e.small(si.Token, si.Pos(), top)
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return e.fail(si.Token, si.Pos(), fmt.Errorf("negative shift count %d", n))
+	}
+	if e.big && si.Token == "lengthen" && n > maxBigShift {
+		// a fixed-width cell just loses the bits, but a big integer would grow to hold them
+		return e.fail(si.Token, si.Pos(), fmt.Errorf("shift count %d is more than the %d bits a big integer may be shifted by", n, maxBigShift))
+	}
+	f := e.num.shr
+	if si.Token == "lengthen" {
+		f = e.num.shl
+	}
+	return e.binary(si, func(second, _ T) (T, bool) { return f(second, uint(n)) })
+}
+
+// truth returns the cell for a boolean: 1 or 0.
+func (e *walker[T]) truth(b bool) T {
+	if b {
+		return e.one
+	}
+	return e.zero
+}
+
+// depthArg parses the depth argument of `pick` and `roll`.
+func (e *walker[T]) depthArg(si *parser.SimpleInstr) (int, error) {
+	if len(si.Args) != 1 {
+		return 0, e.fail(si.Token, si.Pos(), fmt.Errorf("missing depth argument"))
+	}
+	depth, err := strconv.Atoi(si.Args[0])
+	if err != nil || depth < 0 {
+		return 0, e.fail(si.Token, si.Pos(), fmt.Errorf("invalid depth %q", si.Args[0]))
+	}
+	return depth, nil
+}
+
+// anys copies xs into a []any.
+func anys[T any](xs []T) []any {
+	values := make([]any, len(xs))
+	for i, x := range xs {
+		values[i] = x
+	}
+	return values
+}
@@ -0,0 +1,311 @@
+package evaluator
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/svader0/yarnball/pkg/stack"
+)
+
+// Overflow is what happens to a result that does not fit in a cell.
+type Overflow int
+
+const (
+	Wrap     Overflow = iota // keep the low bits, as Go's integer arithmetic does
+	Saturate                 // clamp to the smallest or largest value a cell holds
+	Trap                     // stop the pattern with an OverflowError
+)
+
+// arith is the integer arithmetic of a numeric mode. A value is never changed
+// once it has been made, so values can be shared freely between the stack, the
+// markers and the skein.
+//
+// Every method that makes a value reports false when the result overflowed and
+// the mode traps overflow; wrapping and saturating modes always report true.
+type arith[T any] interface {
+	fromInt(n int) (T, bool)
+	toInt(x T) (int, bool) // false when x does not fit in an int
+	add(a, b T) (T, bool)
+	sub(a, b T) (T, bool)
+	mul(a, b T) (T, bool)
+	quo(a, b T) (T, bool) // truncated towards zero, like Go's /
+	rem(a, b T) (T, bool) // takes the sign of a, like Go's %
+	and(a, b T) (T, bool)
+	or(a, b T) (T, bool)
+	xor(a, b T) (T, bool)
+	not(x T) (T, bool)
+	shl(x T, n uint) (T, bool)
+	shr(x T, n uint) (T, bool) // arithmetic (sign-extending) for signed cells
+	cmp(a, b T) int
+	sign(x T) int
+	scan(r io.Reader) (T, error) // errOverflow when the number read traps
+}
+
+// errOverflow is returned by arith.scan for a number that traps.
+var errOverflow = errors.New("overflow")
+
+// ints is the default mode: 64-bit signed cells that wrap around on overflow.
+// It is fixed[int] with the Wrap policy, minus the overflow checks.
+type ints struct{}
+
+func (ints) fromInt(n int) (int, bool)     { return n, true }
+func (ints) toInt(x int) (int, bool)       { return x, true }
+func (ints) add(a, b int) (int, bool)      { return a + b, true }
+func (ints) sub(a, b int) (int, bool)      { return a - b, true }
+func (ints) mul(a, b int) (int, bool)      { return a * b, true }
+func (ints) quo(a, b int) (int, bool)      { return a / b, true }
+func (ints) rem(a, b int) (int, bool)      { return a % b, true }
+func (ints) and(a, b int) (int, bool)      { return a & b, true }
+func (ints) or(a, b int) (int, bool)       { return a | b, true }
+func (ints) xor(a, b int) (int, bool)      { return a ^ b, true }
+func (ints) not(x int) (int, bool)         { return ^x, true }
+func (ints) shl(x int, n uint) (int, bool) { return x << n, true }
+func (ints) shr(x int, n uint) (int, bool) { return x >> n, true }
+func (ints) cmp(a, b int) int              { return cmp.Compare(a, b) }
+func (ints) sign(x int) int                { return cmp.Compare(x, 0) }
+
+func (ints) scan(r io.Reader) (int, error) {
+	var n int
+	_, err := fmt.Fscan(r, &n)
+	return n, err
+}
+
+// intOp is an operation of the default mode's fast path; see intBinary.
+type intOp byte
+
+const (
+	intAdd intOp = iota
+	intSub
+	intMul
+	intQuo
+	intRem
+	intAnd
+	intOr
+	intXor
+	intGreater
+	intLess
+	intEq
+	intNeq
+)
+
+// intBinary pops the top two values of st and pushes op(second, top), doing
+// the arithmetic directly rather than through arith, which would cost every
+// default-mode pattern an interface call per stitch. It reports false, and
+// leaves st alone, when st holds fewer than two values or op would divide by
+// zero, so that the caller can report the error.
+func intBinary(st *stack.Stack[int], op intOp) bool {
+	top, _ := st.PeekAt(0)
+	second, err := st.PeekAt(1)
+	if err != nil || (top == 0 && (op == intQuo || op == intRem)) {
+		return false
+	}
+	var x int
+	switch op {
+	case intAdd:
+		x = second + top
+	case intSub:
+		x = second - top
+	case intMul:
+		x = second * top
+	case intQuo:
+		x = second / top
+	case intRem:
+		x = second % top
+	case intAnd:
+		x = second & top
+	case intOr:
+		x = second | top
+	case intXor:
+		x = second ^ top
+	case intGreater:
+		x = boolInt(second > top)
+	case intLess:
+		x = boolInt(second < top)
+	case intEq:
+		x = boolInt(second == top)
+	case intNeq:
+		x = boolInt(second != top)
+	}
+	_, _ = st.Pop()
+	_, _ = st.Pop()
+	st.Push(x)
+	return true
+}
+
+// intAddTop adds n to the top value of st, like intBinary, and reports false
+// when st is empty.
+func intAddTop(st *stack.Stack[int], n int) bool {
+	top, err := st.Pop()
+	if err != nil {
+		return false
+	}
+	st.Push(top + n)
+	return true
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// integer lists the cell types of the fixed-width modes. int stands in for
+// int64 so that the 64-bit signed modes share the default mode's stack type.
+type integer interface {
+	int | int8 | int16 | int32 | uint8 | uint16 | uint32 | uint64
+}
+
+// fixed is a fixed-width mode with an overflow policy, chosen by WithCells and
+// WithOverflow.
+type fixed[T integer] struct {
+	overflow Overflow
+	lo, hi   T // the smallest and largest values a cell holds
+}
+
+// newFixed returns the mode for T, which is bits wide.
+func newFixed[T integer](bits int, overflow Overflow) fixed[T] {
+	f := fixed[T]{overflow: overflow, hi: ^T(0)}
+	if f.hi < 0 {
+		// signed: ^0 is -1
+		f.hi = T(1)<<(bits-1) - 1
+		f.lo = -f.hi - 1
+	}
+	return f
+}
+
+// overflowed applies the policy to a result that did not fit: wrapped is the
+// wrapped-around result, and up says whether the true result was too large
+// rather than too small.
+func (f fixed[T]) overflowed(wrapped T, up bool) (T, bool) {
+	switch f.overflow {
+	case Saturate:
+		if up {
+			return f.hi, true
+		}
+		return f.lo, true
+	case Trap:
+		return wrapped, false
+	}
+	return wrapped, true
+}
+
+func (f fixed[T]) fromInt(n int) (T, bool) {
+	x := T(n)
+	if int(x) != n || (x < 0) != (n < 0) {
+		return f.overflowed(x, n > 0)
+	}
+	return x, true
+}
+
+func (f fixed[T]) toInt(x T) (int, bool) {
+	n := int(x)
+	return n, T(n) == x && (n < 0) == (x < 0)
+}
+
+func (f fixed[T]) add(a, b T) (T, bool) {
+	s := a + b
+	if (b > 0 && s < a) || (b < 0 && s > a) {
+		return f.overflowed(s, b > 0)
+	}
+	return s, true
+}
+
+func (f fixed[T]) sub(a, b T) (T, bool) {
+	d := a - b
+	if (b > 0 && d > a) || (b < 0 && d < a) {
+		return f.overflowed(d, b < 0)
+	}
+	return d, true
+}
+
+func (f fixed[T]) mul(a, b T) (T, bool) {
+	p := a * b
+	// the second test catches lo * -1, which is lo again in signed modes
+	if a != 0 && (p/a != b || (f.lo < 0 && a == ^T(0) && b == f.lo)) {
+		return f.overflowed(p, (a < 0) == (b < 0))
+	}
+	return p, true
+}
+
+func (f fixed[T]) quo(a, b T) (T, bool) {
+	if f.lo < 0 && a == f.lo && b == ^T(0) {
+		// lo / -1 is the only quotient that does not fit
+		return f.overflowed(a, true)
+	}
+	return a / b, true
+}
+
+func (f fixed[T]) rem(a, b T) (T, bool) { return a % b, true }
+func (f fixed[T]) and(a, b T) (T, bool) { return a & b, true }
+func (f fixed[T]) or(a, b T) (T, bool)  { return a | b, true }
+func (f fixed[T]) xor(a, b T) (T, bool) { return a ^ b, true }
+func (f fixed[T]) not(x T) (T, bool)    { return ^x, true }
+
+func (f fixed[T]) shl(x T, n uint) (T, bool) {
+	s := x << n
+	if s>>n != x {
+		// bits, or the sign, were shifted out
+		return f.overflowed(s, x > 0)
+	}
+	return s, true
+}
+
+func (f fixed[T]) shr(x T, n uint) (T, bool) { return x >> n, true }
+func (f fixed[T]) cmp(a, b T) int            { return cmp.Compare(a, b) }
+func (f fixed[T]) sign(x T) int              { return cmp.Compare(x, 0) }
+
+// scan reads an int and converts it like fromInt, so the overflow policy
+// applies to input too.
+func (f fixed[T]) scan(r io.Reader) (T, error) {
+	var n int
+	if _, err := fmt.Fscan(r, &n); err != nil {
+		return 0, err
+	}
+	x, ok := f.fromInt(n)
+	if !ok {
+		return x, errOverflow
+	}
+	return x, nil
+}
+
+// bigs is the arbitrary-precision mode selected by WithBigIntegers. Every
+// result is a new *big.Int, and none overflows.
+type bigs struct{}
+
+// maxBigShift is the most bits lengthen shifts a big integer by at once, so
+// that one stitch cannot ask for more memory than the machine has.
+const maxBigShift = 1 << 24
+
+func (bigs) fromInt(n int) (*big.Int, bool) { return big.NewInt(int64(n)), true }
+
+func (bigs) toInt(x *big.Int) (int, bool) {
+	if !x.IsInt64() {
+		return 0, false
+	}
+	n := x.Int64()
+	return int(n), int64(int(n)) == n
+}
+
+func (bigs) add(a, b *big.Int) (*big.Int, bool)      { return new(big.Int).Add(a, b), true }
+func (bigs) sub(a, b *big.Int) (*big.Int, bool)      { return new(big.Int).Sub(a, b), true }
+func (bigs) mul(a, b *big.Int) (*big.Int, bool)      { return new(big.Int).Mul(a, b), true }
+func (bigs) quo(a, b *big.Int) (*big.Int, bool)      { return new(big.Int).Quo(a, b), true }
+func (bigs) rem(a, b *big.Int) (*big.Int, bool)      { return new(big.Int).Rem(a, b), true }
+func (bigs) and(a, b *big.Int) (*big.Int, bool)      { return new(big.Int).And(a, b), true }
+func (bigs) or(a, b *big.Int) (*big.Int, bool)       { return new(big.Int).Or(a, b), true }
+func (bigs) xor(a, b *big.Int) (*big.Int, bool)      { return new(big.Int).Xor(a, b), true }
+func (bigs) not(x *big.Int) (*big.Int, bool)         { return new(big.Int).Not(x), true }
+func (bigs) shl(x *big.Int, n uint) (*big.Int, bool) { return new(big.Int).Lsh(x, n), true }
+func (bigs) shr(x *big.Int, n uint) (*big.Int, bool) { return new(big.Int).Rsh(x, n), true }
+func (bigs) cmp(a, b *big.Int) int                   { return a.Cmp(b) }
+func (bigs) sign(x *big.Int) int                     { return x.Sign() }
+
+func (bigs) scan(r io.Reader) (*big.Int, error) {
+	n := new(big.Int)
+	_, err := fmt.Fscan(r, n)
+	return n, err
+}
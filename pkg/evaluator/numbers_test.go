@@ -0,0 +1,302 @@
+package evaluator
+
+import (
+	"errors"
+	"io"
+	"math"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/svader0/yarnball/pkg/parser"
+)
+
+// run evaluates src with opts, printing to out.
+func run(t *testing.T, src string, out io.Writer, opts ...Option) error {
+	t.Helper()
+	prog, err := parser.ParseFile(nil, "", src)
+	if err != nil {
+		t.Fatalf("parse %q: %v", src, err)
+	}
+	opts = append([]Option{WithOutput(out), WithInput(strings.NewReader(""))}, opts...)
+	return New(nil, opts...).Eval(prog)
+}
+
+// TestBigShiftLimit checks that lengthen refuses a shift that would make a
+// big integer too large to hold, rather than trying to allocate it.
+func TestBigShiftLimit(t *testing.T) {
+	for _, src := range []string{
+		"ch 1 ch 9223372036854775807 lengthen",
+		"ch 1 ch 1099511627776 lengthen",
+		"ch 1 ch 16777217 lengthen",
+	} {
+		err := run(t, src, io.Discard, WithBigIntegers())
+		var rt *RuntimeError
+		if !errors.As(err, &rt) || !strings.Contains(err.Error(), "shift count") {
+			t.Errorf("%q: got %v, want a runtime error for the shift count", src, err)
+			continue
+		}
+		if code, ok := ErrorCode(err); !ok || code != CodeFailed {
+			t.Errorf("%q: got error code %d, %t, want %d", src, code, ok, CodeFailed)
+		}
+	}
+
+	var out strings.Builder
+	src := "ch 1 ch 16777216 lengthen ch 16777215 shorten yo ch 1 ch 99999999999 shorten yo"
+	if err := run(t, src, &out, WithBigIntegers()); err != nil {
+		t.Fatalf("%q: %v", src, err)
+	}
+	if got := strings.Fields(out.String()); !slices.Equal(got, []string{"2", "0"}) {
+		t.Errorf("%q printed %q, want 2 and 0", src, out.String())
+	}
+}
+
+// fixedCase is an operation of a fixed-width mode on a and b. wrap is its
+// result when wrapping, and when it does not overflow; sat is its result when
+// it overflows and saturates.
+type fixedCase struct {
+	op   string
+	a, b int
+	over bool
+	wrap int
+	sat  int
+}
+
+// testFixed runs cases on the bits-wide mode for T under every overflow
+// policy.
+func testFixed[T integer](t *testing.T, bits int, cases []fixedCase) {
+	t.Helper()
+	for _, c := range cases {
+		for _, policy := range []Overflow{Wrap, Saturate, Trap} {
+			f := newFixed[T](bits, policy)
+			a, b := T(c.a), T(c.b)
+			var got T
+			var ok bool
+			switch c.op {
+			case "fromInt":
+				got, ok = f.fromInt(c.a)
+			case "add":
+				got, ok = f.add(a, b)
+			case "sub":
+				got, ok = f.sub(a, b)
+			case "mul":
+				got, ok = f.mul(a, b)
+			case "quo":
+				got, ok = f.quo(a, b)
+			case "shl":
+				got, ok = f.shl(a, uint(c.b))
+			case "scan":
+				var err error
+				got, err = f.scan(strings.NewReader(strconv.Itoa(c.a)))
+				if err != nil && err != errOverflow {
+					t.Fatalf("%d-bit scan %d: %v", bits, c.a, err)
+				}
+				ok = err == nil
+			default:
+				t.Fatalf("unknown op %q", c.op)
+			}
+			want := T(c.wrap)
+			if c.over && policy == Saturate {
+				want = T(c.sat)
+			}
+			wantOK := !c.over || policy != Trap
+			if ok != wantOK || (ok && got != want) {
+				t.Errorf("%T %s(%d, %d) with policy %d: got %v, %t, want %v, %t", got, c.op, c.a, c.b, policy, got, ok, want, wantOK)
+			}
+		}
+	}
+}
+
+func TestFixedSigned(t *testing.T) {
+	testFixed[int8](t, 8, []fixedCase{
+		{op: "fromInt", a: 127, wrap: 127},
+		{op: "fromInt", a: 200, over: true, wrap: -56, sat: 127},
+		{op: "fromInt", a: -200, over: true, wrap: 56, sat: -128},
+		{op: "add", a: 100, b: 27, wrap: 127},
+		{op: "add", a: 127, b: 1, over: true, wrap: -128, sat: 127},
+		{op: "add", a: -128, b: -1, over: true, wrap: 127, sat: -128},
+		{op: "sub", a: -127, b: 1, wrap: -128},
+		{op: "sub", a: -128, b: 1, over: true, wrap: 127, sat: -128},
+		{op: "sub", a: 127, b: -1, over: true, wrap: -128, sat: 127},
+		{op: "sub", a: -1, b: -128, wrap: 127},
+		{op: "mul", a: -16, b: 8, wrap: -128},
+		{op: "mul", a: 16, b: 8, over: true, wrap: -128, sat: 127},
+		{op: "mul", a: -16, b: 9, over: true, wrap: 112, sat: -128},
+		{op: "mul", a: -128, b: -1, over: true, wrap: -128, sat: 127},
+		{op: "mul", a: -1, b: -128, over: true, wrap: -128, sat: 127},
+		{op: "mul", a: -128, b: 1, wrap: -128},
+		{op: "mul", a: 0, b: -128, wrap: 0},
+		{op: "quo", a: -128, b: -1, over: true, wrap: -128, sat: 127},
+		{op: "quo", a: -128, b: 1, wrap: -128},
+		{op: "quo", a: 127, b: -1, wrap: -127},
+		{op: "shl", a: 1, b: 6, wrap: 64},
+		{op: "shl", a: 1, b: 7, over: true, wrap: -128, sat: 127},
+		{op: "shl", a: 64, b: 1, over: true, wrap: -128, sat: 127},
+		{op: "shl", a: -1, b: 7, wrap: -128},
+		{op: "shl", a: -65, b: 1, over: true, wrap: 126, sat: -128},
+		{op: "shl", a: 3, b: 9, over: true, wrap: 0, sat: 127},
+		{op: "scan", a: -128, wrap: -128},
+		{op: "scan", a: 300, over: true, wrap: 44, sat: 127},
+		{op: "scan", a: -129, over: true, wrap: 127, sat: -128},
+	})
+	testFixed[int](t, 64, []fixedCase{
+		{op: "add", a: math.MaxInt, b: 1, over: true, wrap: math.MinInt, sat: math.MaxInt},
+		{op: "sub", a: math.MinInt, b: 1, over: true, wrap: math.MaxInt, sat: math.MinInt},
+		{op: "mul", a: math.MinInt, b: -1, over: true, wrap: math.MinInt, sat: math.MaxInt},
+		{op: "mul", a: math.MaxInt, b: -1, wrap: -math.MaxInt},
+		{op: "quo", a: math.MinInt, b: -1, over: true, wrap: math.MinInt, sat: math.MaxInt},
+		{op: "shl", a: 1, b: 63, over: true, wrap: math.MinInt, sat: math.MaxInt},
+	})
+}
+
+func TestFixedUnsigned(t *testing.T) {
+	testFixed[uint8](t, 8, []fixedCase{
+		{op: "fromInt", a: 255, wrap: 255},
+		{op: "fromInt", a: 256, over: true, wrap: 0, sat: 255},
+		{op: "fromInt", a: -1, over: true, wrap: 255, sat: 0},
+		{op: "add", a: 200, b: 55, wrap: 255},
+		{op: "add", a: 200, b: 56, over: true, wrap: 0, sat: 255},
+		{op: "sub", a: 5, b: 5, wrap: 0},
+		{op: "sub", a: 0, b: 1, over: true, wrap: 255, sat: 0},
+		{op: "sub", a: 3, b: 200, over: true, wrap: 59, sat: 0},
+		{op: "mul", a: 15, b: 17, wrap: 255},
+		{op: "mul", a: 16, b: 16, over: true, wrap: 0, sat: 255},
+		{op: "quo", a: 255, b: 255, wrap: 1},
+		{op: "shl", a: 1, b: 7, wrap: 128},
+		{op: "shl", a: 1, b: 8, over: true, wrap: 0, sat: 255},
+		{op: "shl", a: 129, b: 1, over: true, wrap: 2, sat: 255},
+		{op: "scan", a: 255, wrap: 255},
+		{op: "scan", a: -1, over: true, wrap: 255, sat: 0},
+	})
+	testFixed[uint64](t, 64, []fixedCase{
+		{op: "fromInt", a: math.MaxInt, wrap: math.MaxInt},
+		{op: "fromInt", a: -1, over: true, wrap: -1, sat: 0},
+		{op: "sub", a: 0, b: 1, over: true, wrap: -1, sat: 0},
+		{op: "mul", a: 1 << 32, b: 1 << 32, over: true, wrap: 0, sat: -1},
+	})
+}
+
+func TestBigs(t *testing.T) {
+	n := func(s string) *big.Int {
+		x, ok := new(big.Int).SetString(s, 10)
+		if !ok {
+			t.Fatalf("bad number %q", s)
+		}
+		return x
+	}
+	var num bigs
+	tests := []struct {
+		op   string
+		a, b string
+		want string
+	}{
+		{"add", "9223372036854775807", "1", "9223372036854775808"},
+		{"sub", "-9223372036854775808", "1", "-9223372036854775809"},
+		{"mul", "4294967296", "-4294967296", "-18446744073709551616"},
+		{"quo", "-7", "2", "-3"}, // truncated, like Go's /
+		{"quo", "-18446744073709551616", "-1", "18446744073709551616"},
+		{"rem", "-7", "2", "-1"}, // the sign of the dividend, like Go's %
+		{"rem", "7", "-2", "1"},
+		{"and", "-1", "18446744073709551621", "18446744073709551621"},
+		{"or", "-8", "3", "-5"},
+		{"xor", "-1", "5", "-6"},
+		{"not", "0", "", "-1"},
+		{"shl", "1", "100", "1267650600228229401496703205376"},
+		{"shl", "-3", "64", "-55340232221128654848"},
+		{"shr", "-5", "1", "-3"}, // keeps the sign, like Go's >>
+		{"shr", "1267650600228229401496703205376", "99", "2"},
+	}
+	for _, tt := range tests {
+		a, b := n(tt.a), new(big.Int)
+		if tt.b != "" {
+			b = n(tt.b)
+		}
+		var got *big.Int
+		var ok bool
+		switch tt.op {
+		case "add":
+			got, ok = num.add(a, b)
+		case "sub":
+			got, ok = num.sub(a, b)
+		case "mul":
+			got, ok = num.mul(a, b)
+		case "quo":
+			got, ok = num.quo(a, b)
+		case "rem":
+			got, ok = num.rem(a, b)
+		case "and":
+			got, ok = num.and(a, b)
+		case "or":
+			got, ok = num.or(a, b)
+		case "xor":
+			got, ok = num.xor(a, b)
+		case "not":
+			got, ok = num.not(a)
+		case "shl":
+			got, ok = num.shl(a, uint(b.Uint64()))
+		case "shr":
+			got, ok = num.shr(a, uint(b.Uint64()))
+		}
+		if !ok || got.String() != tt.want {
+			t.Errorf("%s(%s, %s): got %v, %t, want %s", tt.op, tt.a, tt.b, got, ok, tt.want)
+		}
+		if a.String() != tt.a {
+			t.Errorf("%s(%s, %s) changed its operand to %v", tt.op, tt.a, tt.b, a)
+		}
+	}
+
+	for _, tt := range []struct {
+		x    string
+		want int
+		ok   bool
+	}{
+		{"9223372036854775807", math.MaxInt, true},
+		{"-9223372036854775808", math.MinInt, true},
+		{"9223372036854775808", 0, false},
+		{"-9223372036854775809", 0, false},
+	} {
+		if got, ok := num.toInt(n(tt.x)); got != tt.want || ok != tt.ok {
+			t.Errorf("toInt(%s): got %d, %t, want %d, %t", tt.x, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	got, err := num.scan(strings.NewReader(" 123456789012345678901234567890 "))
+	if err != nil || got.String() != "123456789012345678901234567890" {
+		t.Errorf("scan: got %v, %v", got, err)
+	}
+	if c := num.cmp(n("-18446744073709551616"), n("1")); c != -1 {
+		t.Errorf("cmp: got %d, want -1", c)
+	}
+}
+
+// BenchmarkArithmetic runs a loop of arithmetic in the default mode, which
+// has a fast path of its own, and in the modes that go through arith. The
+// default mode should run about as fast as the evaluator did before it had
+// numeric modes.
+func BenchmarkArithmetic(b *testing.B) {
+	prog, err := parser.ParseFile(nil, "", "ch 0 ch 200000 * swap inc ch 3 dc ch 7 bob ch 1000003 cl swap dec * repeat while")
+	if err != nil {
+		b.Fatal(err)
+	}
+	modes := []struct {
+		name string
+		opts []Option
+	}{
+		{"default", nil},
+		{"i32", []Option{WithCells(32, false)}},
+		{"saturate", []Option{WithOverflow(Saturate)}},
+		{"big", []Option{WithBigIntegers()}},
+	}
+	for _, mode := range modes {
+		b.Run(mode.name, func(b *testing.B) {
+			for range b.N {
+				ev := New(nil, append(mode.opts, WithOutput(io.Discard), WithStepLimit(math.MaxInt))...)
+				if err := ev.Eval(prog); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package evaluator
+
+import (
+	"bufio"
+	"io"
+)
+
+// Option configures an Evaluator at construction time.
+type Option func(*Evaluator)
+
+// WithOutput sets the writer that `pic` and `yo` print to (os.Stdout by default).
+// Output is buffered and flushed whenever Eval returns or input is read.
+func WithOutput(w io.Writer) Option {
+	return func(e *Evaluator) {
+		// bufio.NewWriter reuses w when it is already a *bufio.Writer.
+		e.out = bufio.NewWriter(w)
+	}
+}
+
+// WithInput sets the reader that input stitches read from (os.Stdin by default).
+// Passing a *bufio.Reader lets the host share it without losing read-ahead.
+func WithInput(r io.Reader) Option {
+	return func(e *Evaluator) {
+		// bufio.NewReader reuses r when it is already a *bufio.Reader.
+		e.in = bufio.NewReader(r)
+	}
+}
+
+// WithMemoryLimit sets the most cells the skein may hold (1<<20 by default).
+func WithMemoryLimit(cells int) Option {
+	return func(e *Evaluator) {
+		if cells > 0 {
+			e.memLimit = cells
+		}
+	}
+}
+
+// WithLifelineLimit sets the most cells the lifelines of a pattern may hold
+// between them (1<<22 by default). A lifeline holds a copy of every stack, the
+// global markers and the skein.
+func WithLifelineLimit(cells int) Option {
+	return func(e *Evaluator) {
+		if cells > 0 {
+			e.lineLimit = cells
+		}
+	}
+}
+
+// WithCells sets the width of a cell, the integer the stack, markers and skein
+// hold, to 8, 16, 32 or 64 bits (the default), signed or unsigned. Other widths
+// are ignored.
+func WithCells(bits int, unsigned bool) Option {
+	return func(e *Evaluator) {
+		switch bits {
+		case 8, 16, 32, 64:
+			e.bits, e.unsigned = bits, unsigned
+		}
+	}
+}
+
+// WithOverflow sets what happens to a result that does not fit in a cell (Wrap
+// by default). The policy also applies to numbers pushed by `ch`, strings and
+// input.
+func WithOverflow(policy Overflow) Option {
+	return func(e *Evaluator) {
+		e.overflow = policy
+	}
+}
+
+// WithBigIntegers makes the stack, markers and skein hold arbitrary-precision
+// integers (*big.Int), so arithmetic never overflows. It overrides WithCells
+// and WithOverflow, and is slower than the default mode.
+func WithBigIntegers() Option {
+	return func(e *Evaluator) {
+		e.big = true
+	}
+}
+
+// WithStepLimit sets the maximum number of steps a single Eval may take.
+func WithStepLimit(limit int) Option {
+	return func(e *Evaluator) {
+		e.SetStepLimit(limit)
+	}
+}
@@ -0,0 +1,30 @@
+package evaluator
+
+import (
+	"github.com/svader0/yarnball/pkg/parser"
+)
+
+// Program is a resolved pattern, ready to run. It is never modified after
+// Prepare returns, so a pattern can be parsed and prepared once and then run
+// by any number of Evaluators at the same time, one per goroutine.
+type Program struct {
+	instructions []parser.Instruction
+	stitches     map[string]*parser.StitchDef
+}
+
+// Prepare resolves prog (see parser.Resolve) into a Program. Undefined or
+// duplicate stitch names are returned as a parser.ErrorList. prog must not be
+// modified afterwards.
+func Prepare(prog *parser.Program) (*Program, error) {
+	if err := parser.Resolve(prog, nil); err != nil {
+		return nil, err
+	}
+	p := &Program{
+		instructions: prog.Instructions,
+		stitches:     make(map[string]*parser.StitchDef, len(prog.Stitches)),
+	}
+	for _, def := range prog.Stitches {
+		p.stitches[def.Name] = def
+	}
+	return p, nil
+}
@@ -1,7 +1,9 @@
 package lexer
 
 import (
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -12,6 +14,7 @@ type Token struct {
 	Literal string
 	Line    int
 	Column  int
+	Len     int // length of the token in the source, in bytes
 }
 
 const (
@@ -20,9 +23,11 @@ const (
 	EOF     = "EOF"
 
 	// Literals
-	IDENT  = "IDENT" // names, stitch names, or unknown mnemonics
-	INT    = "INT"
+	IDENT  = "IDENT"  // names, stitch names, or unknown mnemonics
+	INT    = "INT"    // Literal is the source text: 12, -3, 0x1f, 0b101 or 'A'
+	STRING = "STRING" // Literal holds the decoded text, without quotes
 	FILLER = "FILLER"
+	ROW    = "ROW" // a "Row N:" or "Round N:" label; Literal is the label without the colon
 
 	// Delimiters
 	LPAREN   = "("
@@ -63,6 +68,41 @@ const (
 	WHILE       = "WHILE"
 	STITCHDEF   = "STITCHDEF"
 	USE         = "USE"
+	PULLUP      = "PULLUP"      // "pull up loop": read one character
+	DRAWTHROUGH = "DRAWTHROUGH" // "draw through": read one integer
+	EMBROIDER   = "EMBROIDER"   // print a counted string
+	PM          = "PM"          // place marker: pop into a named marker
+	SM          = "SM"          // slip marker: push a marker's value
+	GLOBAL      = "GLOBAL"
+	WIND        = "WIND"     // grow the skein (memory) by n cells
+	STASH       = "STASH"    // store into the skein
+	UNSTASH     = "UNSTASH"  // fetch from the skein
+	MEASURE     = "MEASURE"  // push the skein's size
+	SNIP        = "SNIP"     // leave the innermost repeat (break)
+	SKIP        = "SKIP"     // start the next pass of the innermost repeat (continue)
+	TIEOFF      = "TIEOFF"   // "tie off": leave the current stitch (return)
+	STACK       = "STACK"    // as in "repeat from stack"
+	TALLY       = "TALLY"    // push the pass number of the innermost repeat
+	WEAVE       = "WEAVE"    // bitwise and
+	MESH        = "MESH"     // bitwise or
+	CROSS       = "CROSS"    // bitwise exclusive or
+	CRAB        = "CRAB"     // bitwise not (crab stitch is worked in reverse)
+	LENGTHEN    = "LENGTHEN" // shift left
+	SHORTEN     = "SHORTEN"  // shift right
+	TOG         = "TOG"      // logical and: two stitches worked together
+	ALT         = "ALT"      // logical or: one or the other, alternately
+	KNOT        = "KNOT"     // logical not
+	CHANGE      = "CHANGE"   // as in "change to color B": switch stacks
+	COLOR       = "COLOR"    // "color" or "colour"
+	CARRY       = "CARRY"    // move the top value to another colour's stack
+	PICKUP      = "PICKUP"   // "pick up": move the top value of another colour's stack here
+	LIFELINE    = "LIFELINE" // record a checkpoint of the machine state
+	FROG        = "FROG"     // rip back to the most recent lifeline
+	PULLOUT     = "PULLOUT"  // "pull out lifeline": drop the most recent lifeline
+	TRY         = "TRY"      // start a block whose runtime errors are rescued
+	RESCUE      = "RESCUE"   // the branch a try block runs after an error
+	SNAG        = "SNAG"     // raise an error with a code taken from the stack
+	JOIN        = "JOIN"     // "join pattern": load the stitches of another file
 )
 
 var keywords = map[string]TokenType{
@@ -96,6 +136,59 @@ var keywords = map[string]TokenType{
 	"turn":   TURN,
 	"stitch": STITCHDEF,
 	"use":    USE,
+
+	"embroider": EMBROIDER,
+	"pm":        PM,
+	"sm":        SM,
+	"global":    GLOBAL,
+	"wind":      WIND,
+	"stash":     STASH,
+	"unstash":   UNSTASH,
+	"measure":   MEASURE,
+	"snip":      SNIP,
+	"skip":      SKIP,
+	"stack":     STACK,
+	"tally":     TALLY,
+
+	// "and", "or" and "not" would be read as plain English, so the bitwise
+	// and logical stitches have crochet names of their own
+	"weave":    WEAVE,
+	"mesh":     MESH,
+	"cross":    CROSS,
+	"crab":     CRAB,
+	"lengthen": LENGTHEN,
+	"shorten":  SHORTEN,
+	"tog":      TOG,
+	"alt":      ALT,
+	"knot":     KNOT,
+
+	"change": CHANGE,
+	"color":  COLOR,
+	"colour": COLOR,
+	"carry":  CARRY,
+
+	"lifeline": LIFELINE,
+	"frog":     FROG,
+
+	"try":    TRY,
+	"rescue": RESCUE,
+	"snag":   SNAG,
+}
+
+// phrases are multi-word stitch mnemonics. They are matched before single
+// words, and only when the phrase is not followed directly by another letter.
+var phrases = []struct {
+	text    string
+	tokType TokenType
+	literal string
+}{
+	{"sl st", SLST, "slst"},
+	{"pull up loop", PULLUP, "pull up loop"},
+	{"draw through", DRAWTHROUGH, "draw through"},
+	{"tie off", TIEOFF, "tie off"},
+	{"pick up", PICKUP, "pick up"},
+	{"pull out lifeline", PULLOUT, "pull out lifeline"},
+	{"join pattern", JOIN, "join pattern"},
 }
 
 var fillerWords = map[string]struct{}{
@@ -127,6 +220,8 @@ type Lexer struct {
 	ch           byte // current char under examination
 	Line         int
 	Column       int
+	joined       map[string]bool // namespaces of the patterns joined so far
+	last         TokenType       // the last token returned, fillers aside
 }
 
 // New initializes a lexer for the given input.
@@ -137,15 +232,7 @@ func New(input string) *Lexer {
 	// normalize non-breaking spaces -> regular spaces
 	input = strings.ReplaceAll(input, "\u00A0", " ")
 
-	// remove comments
-	reComment := regexp.MustCompile(`#.*`)
-	input = reComment.ReplaceAllString(input, "")
-
-	// remove leading “Row N:” or “Round N:” labels (per-line)
-	reLabel := regexp.MustCompile(`(?m)^\s*(?:Row|Round)\s+\d+:\s*`)
-	input = reLabel.ReplaceAllString(input, "")
-
-	l := &Lexer{input: input, Line: 1}
+	l := &Lexer{input: input, Line: 1, joined: make(map[string]bool)}
 	l.readChar()
 	return l
 }
@@ -171,6 +258,19 @@ func (l *Lexer) readChar() {
 
 // NextToken returns the next token from the input.
 func (l *Lexer) NextToken() Token {
+	tok := l.nextToken()
+	if tok.Type == STRING && l.last == JOIN {
+		// from here on, edges.picot is one name if "lib/edges.yarn" was joined
+		base := path.Base(tok.Literal)
+		l.joined[strings.ToLower(strings.TrimSuffix(base, path.Ext(base)))] = true
+	}
+	if tok.Type != FILLER {
+		l.last = tok.Type
+	}
+	return tok
+}
+
+func (l *Lexer) nextToken() Token {
 	var tok Token
 
 	// skip whitespace and comments if they haven't been caught by the preprocessor
@@ -192,12 +292,22 @@ func (l *Lexer) NextToken() Token {
 	tok.Line = l.Line
 	tok.Column = l.Column
 
-	if len(l.input)-l.position >= 5 &&
-		strings.EqualFold(l.input[l.position:l.position+5], "sl st") {
-		tok.Type = SLST
-		tok.Literal = "slst"
-		// consume all 5 chars: 's','l',' ','s','t'
-		for i := 0; i < 5; i++ {
+	if label := l.matchRowLabel(); label != "" {
+		tok.Type = ROW
+		tok.Literal = strings.Join(strings.Fields(label[:len(label)-1]), " ")
+		tok.Len = len(label)
+		for range label {
+			l.readChar()
+		}
+		return tok
+	}
+
+	if tt, lit, n := l.matchPhrase(); n > 0 {
+		tok.Type = tt
+		tok.Literal = lit
+		tok.Len = n
+		// consume every char of the phrase, spaces included
+		for i := 0; i < n; i++ {
 			l.readChar()
 		}
 		return tok
@@ -220,6 +330,23 @@ func (l *Lexer) NextToken() Token {
 		tok = newToken(GREATERTHAN, l.ch, tok.Line, tok.Column)
 	case '<':
 		tok = newToken(LESSERTHAN, l.ch, tok.Line, tok.Column)
+	case '\'':
+		// character literals are integers; the parser decodes them
+		tok.Type = INT
+		tok.Literal = l.readQuoted()
+		tok.Len = len(tok.Literal)
+		return tok
+	case '"':
+		raw := l.readQuoted()
+		tok.Len = len(raw)
+		if text, err := strconv.Unquote(raw); err == nil {
+			tok.Type = STRING
+			tok.Literal = text
+		} else {
+			tok.Type = ILLEGAL
+			tok.Literal = raw
+		}
+		return tok
 	case 0:
 		tok.Type = EOF
 		tok.Literal = ""
@@ -228,11 +355,13 @@ func (l *Lexer) NextToken() Token {
 			lit := l.readIdentifier()
 			tok.Type = lookupIdent(lit)
 			tok.Literal = lit
+			tok.Len = len(lit)
 			return tok
-		} else if isDigit(l.ch) {
+		} else if isDigit(l.ch) || (l.ch == '-' && isDigit(l.peekChar())) {
 			lit := l.readNumber()
 			tok.Type = INT
 			tok.Literal = lit
+			tok.Len = len(lit)
 			return tok
 		} else {
 			tok = newToken(ILLEGAL, l.ch, tok.Line, tok.Column)
@@ -243,26 +372,130 @@ func (l *Lexer) NextToken() Token {
 	return tok
 }
 
+// matchPhrase reports which multi-word mnemonic, if any, starts at the
+// current position, along with its length in bytes.
+func (l *Lexer) matchPhrase() (TokenType, string, int) {
+	if l.position >= len(l.input) {
+		return "", "", 0
+	}
+	rest := l.input[l.position:]
+	for _, ph := range phrases {
+		n := len(ph.text)
+		if len(rest) < n || !strings.EqualFold(rest[:n], ph.text) {
+			continue
+		}
+		if len(rest) > n && isLetter(rest[n]) {
+			continue
+		}
+		return ph.tokType, ph.literal, n
+	}
+	return "", "", 0
+}
+
+// rowLabel matches a “Row N:” or “Round N:” label. Anything up to the colon
+// belongs to the label, so “Row 3 (RS):” works too.
+var rowLabel = regexp.MustCompile(`^(?i:row|round)[ \t]+[^:\n"']*:`)
+
+// matchRowLabel returns the row label starting at the current character, or
+// "" if there is none. Labels are only recognised at the start of a line.
+func (l *Lexer) matchRowLabel() string {
+	if l.position >= len(l.input) || (l.ch != 'r' && l.ch != 'R') {
+		return ""
+	}
+	for i := l.position - 1; i >= 0 && l.input[i] != '\n'; i-- {
+		if l.input[i] != ' ' && l.input[i] != '\t' {
+			return ""
+		}
+	}
+	return rowLabel.FindString(l.input[l.position:])
+}
+
 func newToken(tt TokenType, ch byte, line, col int) Token {
-	return Token{Type: tt, Literal: string(ch), Line: line, Column: col}
+	return Token{Type: tt, Literal: string(ch), Line: line, Column: col, Len: 1}
 }
 
+// readIdentifier reads a name. A dot between two letters joins them into one
+// name, as in `edges.picot`, a stitch from a joined pattern.
 func (l *Lexer) readIdentifier() string {
 	start := l.position
 	for isLetter(l.ch) {
 		l.readChar()
 	}
+	// A dot is punctuation, as in "inc.yo", unless it follows the namespace
+	// of a joined pattern, or comes in the name after `use`: then it is part
+	// of the name of a joined stitch, like edges.picot.
+	if l.joined[l.input[start:l.position]] || l.last == USE {
+		for isLetter(l.ch) || (l.ch == '.' && isLetter(l.peekChar())) {
+			l.readChar()
+		}
+	}
+	return l.input[start:l.position]
+}
+
+// readQuoted reads a string or character literal, quotes and escapes
+// included, as it appears in the source. The literal stops early at the end of
+// the line if it is never closed.
+func (l *Lexer) readQuoted() string {
+	start := l.position
+	quote := l.ch
+	l.readChar() // opening quote
+	for l.ch != quote && l.ch != '\n' && l.ch != 0 {
+		if l.ch == '\\' {
+			l.readChar()
+			if l.ch == '\n' || l.ch == 0 {
+				break
+			}
+		}
+		l.readChar()
+	}
+	if l.ch == quote {
+		l.readChar() // closing quote
+	}
 	return l.input[start:l.position]
 }
 
+// readNumber reads an integer literal: decimal digits with an optional minus
+// sign, or hex and binary digits after a 0x or 0b prefix.
 func (l *Lexer) readNumber() string {
 	start := l.position
-	for isDigit(l.ch) {
+	if l.ch == '-' {
+		l.readChar()
+	}
+	digit := isDigit
+	if l.ch == '0' {
+		switch l.peekChar() {
+		case 'x', 'X':
+			if isHexDigit(l.peekCharAt(2)) {
+				digit = isHexDigit
+				l.readChar()
+				l.readChar()
+			}
+		case 'b', 'B':
+			// the parser rejects digits other than 0 and 1
+			if isDigit(l.peekCharAt(2)) {
+				l.readChar()
+				l.readChar()
+			}
+		}
+	}
+	for digit(l.ch) {
 		l.readChar()
 	}
 	return l.input[start:l.position]
 }
 
+// peekChar returns the character after the current one, or 0 at the end.
+func (l *Lexer) peekChar() byte {
+	return l.peekCharAt(1)
+}
+
+func (l *Lexer) peekCharAt(offset int) byte {
+	if l.position+offset >= len(l.input) {
+		return 0
+	}
+	return l.input[l.position+offset]
+}
+
 func isLetter(ch byte) bool {
 	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
 }
@@ -271,6 +504,10 @@ func isDigit(ch byte) bool {
 	return ch >= '0' && ch <= '9'
 }
 
+func isHexDigit(ch byte) bool {
+	return isDigit(ch) || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
 func lookupIdent(ident string) TokenType {
 	lower := strings.ToLower(ident)
 	if tok, ok := keywords[lower]; ok {
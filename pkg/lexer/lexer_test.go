@@ -0,0 +1,30 @@
+package lexer
+
+import (
+	"slices"
+	"testing"
+)
+
+// TestDottedNames checks that a dot is only part of a name when it follows
+// the namespace of a joined pattern, or comes after `use`.
+func TestDottedNames(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"inc.yo", []string{"inc", "yo"}},
+		{"edges.picot", []string{"edges", "picot"}},
+		{`join pattern "lib/edges.yarn" edges.picot edges.trim.bead inc.yo`, []string{"join pattern", "lib/edges.yarn", "edges.picot", "edges.trim.bead", "inc", "yo"}},
+		{"use edges.picot inc.yo", []string{"use", "edges.picot", "inc", "yo"}},
+	}
+	for _, tt := range tests {
+		l := New(tt.src)
+		var got []string
+		for tok := l.NextToken(); tok.Type != EOF; tok = l.NextToken() {
+			got = append(got, tok.Literal)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
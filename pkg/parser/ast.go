@@ -1,19 +1,51 @@
 package parser
 
+import (
+	"fmt"
+	"strconv"
+)
+
 /*
 	The contents of this file define the abstract syntax tree (AST) we are going
 	to use for Yarnball. Each node represents a specific part of the Yarnball
 	program structure, like instructions, stitch definitions, and blocks.
 */
 
+// Pos is a location in the source: 1-based line and column.
+type Pos struct {
+	Line   int
+	Column int
+	File   string // the joined pattern the position is in; "" in the pattern being run
+}
+
+func (p Pos) String() string {
+	if p.File != "" {
+		return fmt.Sprintf("line %d, column %d in %s", p.Line, p.Column, p.File)
+	}
+	return fmt.Sprintf("line %d, column %d", p.Line, p.Column)
+}
+
+// Span records where a node starts (its first token) and ends (just past its
+// last token). Every node embeds one.
+type Span struct {
+	Start Pos
+	End   Pos
+}
+
+func (s Span) Pos() Pos    { return s.Start }
+func (s Span) EndPos() Pos { return s.End }
+
 // base interface for all AST nodes.
 type Node interface {
 	TokenLiteral() string
+	Pos() Pos    // position of the first token
+	EndPos() Pos // position just past the last token
 }
 
 // root node of every parsed file (a program is just a sequence of instructions).
 type Program struct {
 	Instructions []Instruction
+	Stitches     []*StitchDef // every stitch definition, in source order; filled in by Resolve
 }
 
 // represents one “stitch” or a repeat block.
@@ -26,33 +58,50 @@ type Instruction interface {
 type SimpleInstr struct {
 	Token string // literal, e.g. "ch" or "pic"
 	Args  []string
+	Span
 }
 
 func (si *SimpleInstr) instructionNode()     {}
 func (si *SimpleInstr) TokenLiteral() string { return si.Token }
 
+// StringInstr is a quoted string literal. It pushes the characters of Value,
+// last character first, and then their count.
+type StringInstr struct {
+	Value string
+	Span
+}
+
+func (*StringInstr) instructionNode()        {}
+func (st *StringInstr) TokenLiteral() string { return strconv.Quote(st.Value) }
+
 type RepeatMode int
 
 const (
 	RepeatCount RepeatMode = iota
 	RepeatUntil
 	RepeatWhile
+	RepeatStack // the count is popped when the repeat starts
 )
 
-// RepeatInstr represents a repeat block.
+// RepeatInstr represents a repeat block. Count is only used by RepeatCount.
 type RepeatInstr struct {
 	Mode  RepeatMode
 	Count int
 	Body  []Instruction
+	Span
 }
 
 func (ri *RepeatInstr) instructionNode()     {}
 func (ri *RepeatInstr) TokenLiteral() string { return "repeat" }
 
-// StitchDef defines a reusable stitch pattern.
+// StitchDef defines a reusable stitch pattern. Each call pops one value per
+// parameter, the last parameter from the top of the stack, and binds them as
+// markers local to the call.
 type StitchDef struct {
-	Name string
-	Body []Instruction
+	Name   string
+	Params []string
+	Body   []Instruction
+	Span
 }
 
 func (*StitchDef) instructionNode()        {}
@@ -60,14 +109,100 @@ func (sd *StitchDef) TokenLiteral() string { return "stitch" }
 
 type CallInstr struct {
 	Name string
+	Span
 }
 
 func (*CallInstr) instructionNode()        {}
 func (ci *CallInstr) TokenLiteral() string { return ci.Name }
 
+// MarkerInstr places (pm) or slips (sm) a stitch marker, a named variable.
+// Markers are local to the stitch call that places them unless Global is set;
+// at the top level every marker is global.
+type MarkerInstr struct {
+	Op     string // "pm" or "sm"
+	Name   string
+	Global bool
+	Span
+}
+
+func (*MarkerInstr) instructionNode()        {}
+func (mi *MarkerInstr) TokenLiteral() string { return mi.Op }
+
+// MainColor is the colour, and so the stack, every pattern starts in.
+const MainColor = "a"
+
+// ColorInstr works with the stacks of several yarn colours. Op is "change"
+// (work with Color's stack from now on), "carry" (pop here, push onto Color's
+// stack) or "pick up" (pop from Color's stack, push here).
+type ColorInstr struct {
+	Op    string
+	Color string
+	Span
+}
+
+func (*ColorInstr) instructionNode()        {}
+func (ci *ColorInstr) TokenLiteral() string { return ci.Op }
+
+type ControlKind int
+
+const (
+	Snip   ControlKind = iota // leave the innermost repeat
+	Skip                      // start the next pass of the innermost repeat
+	TieOff                    // leave the current stitch call
+)
+
+// ControlInstr leaves a repeat or stitch early. The parser only accepts snip
+// and skip inside a repeat block, and tie off inside a stitch definition.
+type ControlInstr struct {
+	Kind  ControlKind
+	Token string // "snip", "skip" or "tie off"
+	Span
+}
+
+func (*ControlInstr) instructionNode()        {}
+func (ci *ControlInstr) TokenLiteral() string { return ci.Token }
+
+// CountInstr is the stitch count that ends a row, as in `Row 3: sc 6 (12)`.
+// It checks that the stack holds Want values. Row is the row's label, or ""
+// when the line has none.
+type CountInstr struct {
+	Row  string
+	Want int
+	Span
+}
+
+func (*CountInstr) instructionNode()        {}
+func (ci *CountInstr) TokenLiteral() string { return fmt.Sprintf("(%d)", ci.Want) }
+
+// JoinInstr joins another pattern file, making its stitches available under
+// the file's name: `join pattern "lib/edges.yarn"` defines edges.picot for
+// each stitch picot in the file. ParseFile fills in Body with the joined
+// pattern's stitch definitions and joins, already renamed; ParseProgram leaves
+// it empty.
+type JoinInstr struct {
+	Path string // as written, relative to the joining file
+	Body []Instruction
+	Span
+}
+
+func (*JoinInstr) instructionNode()     {}
+func (*JoinInstr) TokenLiteral() string { return "join pattern" }
+
+// TryInstr runs Body, and if a runtime error stops it, pushes the error's
+// code and runs Rescue instead of failing the pattern.
+type TryInstr struct {
+	Body   []Instruction
+	Rescue []Instruction // run after an error in Body
+	Span
+}
+
+func (*TryInstr) instructionNode()     {}
+func (*TryInstr) TokenLiteral() string { return "try" }
+
 type IfInstr struct {
 	IfBody   []Instruction // instructions to execute if condition is true
 	ElseBody []Instruction // instructions to execute if condition is false (if any)
+	Span
 }
 
 func (*IfInstr) instructionNode()     {}
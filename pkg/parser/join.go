@@ -0,0 +1,179 @@
+package parser
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/svader0/yarnball/pkg/lexer"
+	"github.com/svader0/yarnball/pkg/preprocessor"
+)
+
+/*
+	Joining patterns. `join pattern "lib/edges.yarn"` parses another file and
+	makes its stitches available under the file's name, so its picot stitch is
+	called as edges.picot. Inside the joined file the stitches keep their plain
+	names. Files are read from an fs.FS, so a host can serve its own library
+	of patterns (from an embed.FS, say) as easily as the command line serves
+	the directory a pattern is in.
+*/
+
+// ParseFile preprocesses and parses src, the pattern at name in fsys, then
+// every pattern it joins, reading them from fsys. Join paths are relative to
+// the directory of the joining file, and cannot leave fsys. name may be ""
+// for a pattern that is not in fsys (REPL input, say); it then joins
+// relative to the root of fsys. fsys may be nil for a pattern that joins
+// nothing; its joins are then reported as errors.
+//
+// Positions in joined patterns carry the file's path in fsys (see Pos.File);
+// positions in src do not. Syntax errors, and joins that are missing, not at
+// the top level, or that join their own file again, are returned as an
+// ErrorList.
+func ParseFile(fsys fs.FS, name, src string) (*Program, error) {
+	j := &joiner{fsys: fsys, chain: []string{name}}
+	prog, errs := j.parse("", src)
+	if prog != nil {
+		j.joinAll(prog, name)
+	}
+	errs = append(errs, j.errors...)
+	errs.Sort()
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	return prog, nil
+}
+
+type joiner struct {
+	fsys   fs.FS
+	chain  []string // the files being joined, the pattern being run first
+	errors ErrorList
+}
+
+// parse parses src; file is the Pos.File of its nodes.
+func (j *joiner) parse(file, src string) (*Program, ErrorList) {
+	processed, err := preprocessor.New().Process(src)
+	if err != nil {
+		return nil, ErrorList{{Pos: Pos{Line: 1, Column: 1, File: file}, Msg: err.Error()}}
+	}
+	p := New(lexer.New(processed))
+	p.file = file
+	prog, err := p.ParseProgram()
+	if err != nil {
+		return nil, p.Errors()
+	}
+	return prog, nil
+}
+
+// joinAll fills in every join at the top level of prog, which was read from
+// name, and reports joins anywhere else.
+func (j *joiner) joinAll(prog *Program, name string) {
+	namespaces := make(map[string]*JoinInstr)
+	for _, instr := range prog.Instructions {
+		join, ok := instr.(*JoinInstr)
+		if !ok {
+			walk([]Instruction{instr}, func(instr Instruction) {
+				if join, ok := instr.(*JoinInstr); ok {
+					j.errorf(join.Pos(), "join pattern must be at the top level, outside stitches and blocks")
+				}
+			})
+			continue
+		}
+		ns := namespace(join.Path)
+		if ns == "" {
+			j.errorf(join.Pos(), "join pattern %q: the file name must be letters only, as it names the pattern's stitches", join.Path)
+			continue
+		}
+		if prev, exists := namespaces[ns]; exists {
+			j.errorf(join.Pos(), "join pattern %q: a pattern named %s is already joined at %s", join.Path, ns, prev.Pos())
+			continue
+		}
+		namespaces[ns] = join
+		j.join(join, name, ns)
+	}
+}
+
+// join reads, parses and renames the pattern join names, as joined from
+// the file from.
+func (j *joiner) join(join *JoinInstr, from, ns string) {
+	if path.IsAbs(join.Path) {
+		j.errorf(join.Pos(), "join pattern %q: the path must be relative", join.Path)
+		return
+	}
+	name := path.Join(path.Dir(from), join.Path)
+	if !fs.ValidPath(name) {
+		j.errorf(join.Pos(), "join pattern %q: the path leaves the directory patterns are joined from", join.Path)
+		return
+	}
+	for i, file := range j.chain {
+		if file == name {
+			cycle := strings.Join(append(j.chain[i:], name), " -> ")
+			j.errorf(join.Pos(), "join pattern %q: the pattern joins itself (%s)", join.Path, cycle)
+			return
+		}
+	}
+	if j.fsys == nil {
+		j.errorf(join.Pos(), "join pattern %q: joins need a file system to read patterns from", join.Path)
+		return
+	}
+	data, err := fs.ReadFile(j.fsys, name)
+	if err != nil {
+		j.errorf(join.Pos(), "join pattern %q: %v", join.Path, err)
+		return
+	}
+
+	prog, errs := j.parse(name, string(data))
+	if errs != nil {
+		j.errors = append(j.errors, errs...)
+		return
+	}
+	j.chain = append(j.chain, name)
+	j.joinAll(prog, name)
+	j.chain = j.chain[:len(j.chain)-1]
+
+	for _, instr := range prog.Instructions {
+		switch instr.(type) {
+		case *StitchDef, *JoinInstr:
+		default:
+			j.errorf(instr.Pos(), "only stitch definitions can be joined, found %s", instr.TokenLiteral())
+		}
+	}
+	rename(prog.Instructions, ns)
+	join.Body = prog.Instructions
+}
+
+// rename puts every stitch defined in instrs, those of the patterns they join
+// included, in the namespace ns, along with the calls to them.
+func rename(instrs []Instruction, ns string) {
+	defined := make(map[string]bool)
+	walk(instrs, func(instr Instruction) {
+		if def, ok := instr.(*StitchDef); ok {
+			defined[def.Name] = true
+		}
+	})
+	walk(instrs, func(instr Instruction) {
+		switch node := instr.(type) {
+		case *StitchDef:
+			node.Name = ns + "." + node.Name
+		case *CallInstr:
+			if defined[node.Name] {
+				node.Name = ns + "." + node.Name
+			}
+		}
+	})
+}
+
+// namespace returns the name a joined file's stitches are called by: its
+// base name without the extension, or "" if that is not letters only.
+func namespace(file string) string {
+	base := path.Base(file)
+	ns := strings.ToLower(strings.TrimSuffix(base, path.Ext(base)))
+	if ns == "" || strings.ContainsFunc(ns, func(r rune) bool { return r < 'a' || r > 'z' }) {
+		return ""
+	}
+	return ns
+}
+
+func (j *joiner) errorf(pos Pos, format string, args ...any) {
+	j.errors = append(j.errors, &Diagnostic{Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
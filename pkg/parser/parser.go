@@ -1,8 +1,12 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
+	"slices"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/svader0/yarnball/pkg/lexer"
 )
@@ -10,39 +14,122 @@ import (
 type Parser struct {
 	l         *lexer.Lexer
 	cur, peek lexer.Token
+	end       Pos            // just past the most recently consumed token
+	consumed  int            // number of tokens consumed so far
+	params    []string       // parameters of the stitch whose body is being parsed
+	inStitch  bool           // parsing a stitch body
+	loops     int            // repeat blocks enclosing the current token, inside the current stitch
+	rows      map[int]string // row labels, by line
+	file      string         // set by ParseFile for joined patterns; see Pos.File
+	errors    ErrorList
 }
 
 func New(l *lexer.Lexer) *Parser {
-	p := &Parser{l: l}
+	p := &Parser{l: l, rows: make(map[int]string)}
 	p.nextToken() // Initialize current token
 	p.nextToken() // Initialize peek token
+	p.consumed = 0
 	return p
 }
 
 // nextToken advances the parser to the next token, updating current and peek tokens.
 func (p *Parser) nextToken() {
+	p.end = Pos{Line: p.cur.Line, Column: p.cur.Column + p.cur.Len, File: p.file}
 	p.cur = p.peek
 	p.peek = p.l.NextToken()
+	for p.peek.Type == lexer.ROW {
+		// labels only name rows for stitch counts; they are not instructions
+		p.rows[p.peek.Line] = p.peek.Literal
+		p.peek = p.l.NextToken()
+	}
+	p.consumed++
+}
+
+// Errors returns the syntax errors found so far.
+func (p *Parser) Errors() ErrorList {
+	return p.errors
 }
 
 // Parses the entire program, which consists of a sequence of instructions.
+// Parsing does not stop at the first syntax error: the parser skips ahead to
+// the next row or block boundary and carries on, so the returned program holds
+// every instruction that parsed cleanly, and the error (an ErrorList) reports
+// all syntax errors at once.
 func (p *Parser) ParseProgram() (*Program, error) {
 	prog := &Program{}
-	for p.cur.Type != lexer.EOF {
-		p.skipFillers()
+	for {
+		prog.Instructions = append(prog.Instructions, p.parseBlock()...)
 		if p.cur.Type == lexer.EOF {
 			break
 		}
+		// parseBlock stops at a closing token that nothing here opened
+		p.report(p.errorf("unexpected %s", p.curText()))
+		p.nextToken()
+	}
+	p.errors.Sort()
+	return prog, p.errors.Err()
+}
+
+// parseBlock parses instructions until one of terms, or until a closing token
+// (`)`, `]`, `end`, `else`) that must belong to an enclosing block. Syntax
+// errors are recorded and skipped over, so parseBlock always makes progress.
+func (p *Parser) parseBlock(terms ...lexer.TokenType) []Instruction {
+	var body []Instruction
+	for {
+		p.skipFillers()
+		if p.cur.Type == lexer.EOF || slices.Contains(terms, p.cur.Type) {
+			return body
+		}
+		switch p.cur.Type {
+		case lexer.RPAREN, lexer.RBRACKET, lexer.END, lexer.ELSE, lexer.RESCUE:
+			return body
+		}
+		before := p.consumed
 		instr, err := p.parseInstruction()
 		if err != nil {
-			return nil, err
+			p.report(err)
+			if p.consumed == before {
+				p.nextToken() // always skip the offending token
+			}
+			p.synchronize(p.errors[len(p.errors)-1].Pos.Line)
+			continue
 		}
 		if instr != nil {
-			prog.Instructions = append(prog.Instructions, instr)
+			body = append(body, instr)
 		}
+	}
+}
 
+// synchronize skips the rest of a bad row: it stops at the first token on a
+// later line, or at a token that closes or delimits a block.
+func (p *Parser) synchronize(line int) {
+	for p.cur.Line == line {
+		switch p.cur.Type {
+		case lexer.EOF, lexer.RPAREN, lexer.RBRACKET, lexer.ASTERISK, lexer.END, lexer.ELSE, lexer.RESCUE:
+			return
+		}
+		p.nextToken()
 	}
-	return prog, nil
+}
+
+// report records a syntax error returned by one of the parse functions. An
+// error at the same place as the one before it is dropped: it is the same
+// mistake seen again by an enclosing block, like the unmatched `]` that a
+// stitch body missing its `)` stopped at.
+func (p *Parser) report(err error) {
+	d, ok := err.(*Diagnostic)
+	if !ok {
+		d = &Diagnostic{Pos: p.span().Start, Msg: err.Error()}
+	}
+	if n := len(p.errors); n > 0 && p.errors[n-1].Pos == d.Pos {
+		return
+	}
+	p.errors = append(p.errors, d)
+}
+
+// errorf returns a syntax error at the current token.
+func (p *Parser) errorf(format string, args ...any) *Diagnostic {
+	return &Diagnostic{Pos: p.span().Start, Msg: fmt.Sprintf(format, args...)}
 }
 
 // Parses an instruction based on the current token type.
@@ -56,6 +143,8 @@ func (p *Parser) parseInstruction() (Instruction, error) {
 		return p.parseCh()
 	case lexer.PICK, lexer.ROLL:
 		return p.parsePickRoll()
+	case lexer.FO:
+		return p.parseFo()
 	case lexer.ASTERISK, lexer.LBRACKET:
 		return p.parseRepeatBlock()
 	case lexer.INT:
@@ -64,147 +153,370 @@ func (p *Parser) parseInstruction() (Instruction, error) {
 		return p.parseCall()
 	case lexer.IF:
 		return p.parseIf()
+	case lexer.TRY:
+		return p.parseTry()
+	case lexer.LPAREN:
+		return p.parseStitchCount()
+	case lexer.JOIN:
+		span := p.span()
+		p.nextToken() // consume 'join pattern'
+		if p.cur.Type != lexer.STRING {
+			return nil, p.errorf("expected the path of a pattern file, got %s", p.curText())
+		}
+		join := &JoinInstr{Path: p.cur.Literal, Span: span}
+		p.nextToken()
+		join.End = p.end
+		return join, nil
+	case lexer.PM, lexer.SM:
+		return p.parseMarker()
+	case lexer.CHANGE, lexer.CARRY, lexer.PICKUP:
+		return p.parseColor()
+	case lexer.SNIP, lexer.SKIP, lexer.TIEOFF:
+		return p.parseControl()
+	case lexer.TALLY:
+		instr := &SimpleInstr{Token: "tally", Span: p.span()}
+		if p.loops == 0 {
+			p.report(p.errorf("tally outside a repeat block"))
+			p.nextToken()
+			return nil, nil
+		}
+		p.nextToken()
+		instr.End = p.end
+		return instr, nil
+	case lexer.STRING:
+		instr := &StringInstr{Value: p.cur.Literal, Span: p.span()}
+		p.nextToken()
+		instr.End = p.end
+		return instr, nil
 	case lexer.SC, lexer.SLST, lexer.SWAP,
 		lexer.INC, lexer.DEC, lexer.BOB,
 		lexer.HDC, lexer.DC, lexer.TR, lexer.CL,
 		lexer.GREATERTHAN, lexer.LESSERTHAN, lexer.TURN,
 		lexer.EQ, lexer.NEQ,
-		lexer.OVER, lexer.YO, lexer.PIC, lexer.FO:
+		lexer.OVER, lexer.YO, lexer.PIC,
+		lexer.PULLUP, lexer.DRAWTHROUGH, lexer.EMBROIDER,
+		lexer.WIND, lexer.STASH, lexer.UNSTASH, lexer.MEASURE,
+		lexer.WEAVE, lexer.MESH, lexer.CROSS, lexer.CRAB, lexer.LENGTHEN, lexer.SHORTEN,
+		lexer.TOG, lexer.ALT, lexer.KNOT,
+		lexer.LIFELINE, lexer.FROG, lexer.PULLOUT, lexer.SNAG:
 		return p.parseSimpleWithOptionalCount()
 	case lexer.FILLER:
 		p.nextToken()
 		return nil, nil
+	case lexer.ILLEGAL:
+		if strings.HasPrefix(p.cur.Literal, `"`) {
+			return nil, p.errorf("malformed string %s: missing closing quote or bad escape", p.cur.Literal)
+		}
+		return nil, p.errorf("unexpected token %s", p.curText())
 	default:
-		return nil, fmt.Errorf("unexpected token %q at line %d", p.cur.Literal, p.cur.Line)
+		return nil, p.errorf("unexpected token %s", p.curText())
 	}
 }
 
 // parseCh parses the 'ch' instruction, which expects an INT argument.
 func (p *Parser) parseCh() (Instruction, error) {
-	instr := &SimpleInstr{Token: p.cur.Literal}
+	instr := &SimpleInstr{Token: p.cur.Literal, Span: p.span()}
 	p.nextToken() // consume 'ch'
-	// If next token is INT, just store it
+	// If next token is INT, store its decimal value
 	if p.cur.Type == lexer.INT {
-		instr.Args = append(instr.Args, p.cur.Literal)
+		n, err := p.intLiteral()
+		if err != nil {
+			return nil, err
+		}
+		instr.Args = append(instr.Args, strconv.Itoa(n))
 		p.nextToken() // consume INT
 	} else {
-		return nil, fmt.Errorf("expected INT after ch, got %s", p.cur.Literal)
+		return nil, p.errorf("expected INT after ch, got %s", p.curText())
 	}
+	instr.End = p.end
 	return instr, nil
 }
 
 func (p *Parser) parsePickRoll() (Instruction, error) {
-	instr := &SimpleInstr{Token: p.cur.Literal}
+	instr := &SimpleInstr{Token: p.cur.Literal, Span: p.span()}
 	p.nextToken() // consume 'pick' or 'roll'
 	if p.cur.Type == lexer.INT {
-		instr.Args = append(instr.Args, p.cur.Literal)
+		n, err := p.intLiteral()
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, p.errorf("invalid depth %s for %s", p.curText(), instr.Token)
+		}
+		instr.Args = append(instr.Args, strconv.Itoa(n))
 		p.nextToken() // consume INT
 	} else {
-		return nil, fmt.Errorf("expected INT after %s, got %s", instr.Token, p.cur.Literal)
+		return nil, p.errorf("expected INT after %s, got %s", instr.Token, p.curText())
+	}
+	instr.End = p.end
+	return instr, nil
+}
+
+// MaxExitStatus is the largest status `fo` may finish a pattern with.
+const MaxExitStatus = 125
+
+// parseFo parses the 'fo' instruction, which takes an optional INT exit status.
+func (p *Parser) parseFo() (Instruction, error) {
+	instr := &SimpleInstr{Token: p.cur.Literal, Span: p.span()}
+	p.nextToken() // consume 'fo'
+	// the status must be on the same row: an INT on the next row is not fo's
+	if p.cur.Type == lexer.INT && p.cur.Line == instr.Pos().Line {
+		n, err := p.intLiteral()
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || n > MaxExitStatus {
+			// larger statuses would be cut down to a byte, or mean a signal
+			return nil, p.errorf("exit status %d out of range, must be 0 to %d", n, MaxExitStatus)
+		}
+		instr.Args = append(instr.Args, strconv.Itoa(n))
+		p.nextToken() // consume INT
+	}
+	instr.End = p.end
+	return instr, nil
+}
+
+// parseControl parses snip, skip and tie off, checking that there is a repeat
+// or stitch for them to leave. A misplaced one is reported and dropped.
+func (p *Parser) parseControl() (Instruction, error) {
+	instr := &ControlInstr{Token: strings.ToLower(p.cur.Literal), Span: p.span()}
+	switch p.cur.Type {
+	case lexer.SNIP:
+		instr.Kind = Snip
+	case lexer.SKIP:
+		instr.Kind = Skip
+	default:
+		instr.Kind = TieOff
+	}
+	if instr.Kind == TieOff && !p.inStitch {
+		p.report(p.errorf("tie off outside a stitch definition"))
+		p.nextToken()
+		return nil, nil
+	}
+	if instr.Kind != TieOff && p.loops == 0 {
+		p.report(p.errorf("%s outside a repeat block", instr.Token))
+		p.nextToken()
+		return nil, nil
 	}
+	p.nextToken()
+	instr.End = p.end
+	return instr, nil
+}
+
+// parseMarker parses 'pm [global] name' or 'sm [global] name'.
+func (p *Parser) parseMarker() (Instruction, error) {
+	instr := &MarkerInstr{Op: "sm", Span: p.span()}
+	if p.cur.Type == lexer.PM {
+		instr.Op = "pm"
+	}
+	p.nextToken() // consume 'pm' or 'sm'
+	if p.cur.Type == lexer.GLOBAL {
+		instr.Global = true
+		p.nextToken()
+	}
+	if p.cur.Type != lexer.IDENT {
+		return nil, p.errorf("expected marker name after %s, got %s", instr.Op, p.curText())
+	}
+	instr.Name = p.cur.Literal
+	p.nextToken()
+	instr.End = p.end
+	return instr, nil
+}
+
+// parseColor parses `change to color B`, `carry to color B` and `pick up from
+// color B`. The words "to" and "from" are fillers, and may be left out.
+func (p *Parser) parseColor() (Instruction, error) {
+	instr := &ColorInstr{Op: "pick up", Span: p.span()}
+	switch p.cur.Type {
+	case lexer.CHANGE:
+		instr.Op = "change"
+	case lexer.CARRY:
+		instr.Op = "carry"
+	}
+	p.nextToken() // consume 'change', 'carry' or 'pick up'
+	p.skipFillers()
+	if p.cur.Type != lexer.COLOR {
+		return nil, p.errorf("expected color after %s, got %s", instr.Op, p.curText())
+	}
+	p.nextToken()
+	if p.cur.Type != lexer.IDENT {
+		return nil, p.errorf("expected color name, got %s", p.curText())
+	}
+	instr.Color = p.cur.Literal
+	p.nextToken()
+	instr.End = p.end
 	return instr, nil
 }
 
 func (p *Parser) parseStitchDef() (Instruction, error) {
+	span := p.span()
 	p.nextToken() // consume 'stitch' keyword
 	if p.cur.Type != lexer.IDENT {
-		return nil, fmt.Errorf("expected stitch name, got %s", p.cur.Literal)
+		return nil, p.errorf("expected stitch name, got %s", p.curText())
+	}
+	def := &StitchDef{Name: p.cur.Literal, Span: span}
+	if strings.Contains(def.Name, ".") {
+		// dotted names belong to joined patterns
+		return nil, p.errorf("stitch name %s cannot contain '.'", p.curText())
+	}
+	p.nextToken() // consume name
+
+	// Optional parameter list: '(' names ')'
+	if p.cur.Type == lexer.LPAREN {
+		p.nextToken() // consume '('
+		for p.cur.Type == lexer.IDENT {
+			if slices.Contains(def.Params, p.cur.Literal) {
+				p.report(p.errorf("duplicate parameter %s in stitch %s", p.curText(), def.Name))
+			} else {
+				def.Params = append(def.Params, p.cur.Literal)
+			}
+			p.nextToken()
+		}
+		if p.cur.Type != lexer.RPAREN {
+			// report once, then skip the rest of the list if it closes on this line
+			p.report(p.errorf("expected parameter name or ')', got %s", p.curText()))
+			for line := p.cur.Line; p.cur.Type != lexer.RPAREN && p.cur.Type != lexer.EOF && p.cur.Line == line; {
+				p.nextToken()
+			}
+			if p.cur.Type != lexer.RPAREN {
+				def.End = p.end
+				return def, nil // already reported
+			}
+		}
+		p.nextToken() // consume ')'
 	}
-	def := &StitchDef{Name: p.cur.Literal}
 
 	// Expect '='
-	if p.peek.Type != lexer.ASSIGN {
-		return nil, fmt.Errorf("expected '=', got %s", p.peek.Literal)
+	if p.cur.Type != lexer.ASSIGN {
+		return nil, p.errorf("expected '=', got %s", p.curText())
 	}
-	p.nextToken() // consume name
 	p.nextToken() // consume '='
 
 	if p.cur.Type != lexer.LPAREN {
-		return nil, fmt.Errorf("expected '(', got %s", p.cur.Literal)
+		return nil, p.errorf("expected '(', got %s", p.curText())
 	}
 	p.nextToken() // consume '('
 
-	// Parse instructions until closing ')'
-	for p.cur.Type != lexer.RPAREN && p.cur.Type != lexer.EOF {
-		p.skipFillers()
-		if p.cur.Type == lexer.RPAREN || p.cur.Type == lexer.EOF {
-			break
-		}
-		instr, err := p.parseInstruction()
-		if err != nil {
-			return nil, err
-		}
-		if instr != nil {
-			def.Body = append(def.Body, instr)
-		}
+	// Parse instructions until closing ')'; the parameters are only visible here
+	outerParams, outerStitch, outerLoops := p.params, p.inStitch, p.loops
+	p.params, p.inStitch, p.loops = def.Params, true, 0
+	def.Body = p.parseBlock(lexer.RPAREN)
+	p.params, p.inStitch, p.loops = outerParams, outerStitch, outerLoops
+	if p.cur.Type != lexer.RPAREN {
+		return nil, p.errorf("expected ')' to close stitch %s, got %s", def.Name, p.curText())
 	}
 	p.nextToken() // consume ')'
+	def.End = p.end
 	return def, nil
 }
 
 func (p *Parser) parseUse() (Instruction, error) {
+	span := p.span()
 	p.nextToken() // consume 'use'
 	if p.cur.Type != lexer.IDENT {
-		return nil, fmt.Errorf("expected stitch name, got %s", p.cur.Literal)
+		return nil, p.errorf("expected stitch name, got %s", p.curText())
 	}
-	call := &CallInstr{Name: p.cur.Literal}
+	call := &CallInstr{Name: p.cur.Literal, Span: span}
 	p.nextToken() // advance past the IDENT token
+	call.End = p.end
 	return p.wrapPostfixCount(call)
 }
 
 func (p *Parser) parseCall() (Instruction, error) {
-	call := &CallInstr{Name: p.cur.Literal}
+	if slices.Contains(p.params, p.cur.Literal) {
+		// a parameter name reads the parameter, like `sm name`
+		ref := &MarkerInstr{Op: "sm", Name: p.cur.Literal, Span: p.span()}
+		p.nextToken()
+		ref.End = p.end
+		return ref, nil
+	}
+	call := &CallInstr{Name: p.cur.Literal, Span: p.span()}
 	p.nextToken()
+	call.End = p.end
 	return p.wrapPostfixCount(call)
 }
 
 func (p *Parser) parseIf() (Instruction, error) {
+	span := p.span()
 	// Consume the 'if' token
 	p.nextToken()
 
-	var ifBody []Instruction
 	// Parse IF branch until we hit ELSE or END
-	for p.cur.Type != lexer.ELSE && p.cur.Type != lexer.END && p.cur.Type != lexer.EOF {
-		p.skipFillers()
-		if p.cur.Type == lexer.ELSE || p.cur.Type == lexer.END || p.cur.Type == lexer.EOF {
-			break
-		}
-		instr, err := p.parseInstruction()
-		if err != nil {
-			return nil, err
-		}
-		if instr != nil {
-			ifBody = append(ifBody, instr)
-		}
-	}
+	ifBody := p.parseBlock(lexer.ELSE, lexer.END)
 
 	var elseBody []Instruction
 	// If an ELSE is encountered, parse ELSE branch
 	if p.cur.Type == lexer.ELSE {
 		p.nextToken() // consume 'else'
-		for p.cur.Type != lexer.END && p.cur.Type != lexer.EOF {
-			p.skipFillers()
-			if p.cur.Type == lexer.END || p.cur.Type == lexer.EOF {
-				break
-			}
-			instr, err := p.parseInstruction()
-			if err != nil {
-				return nil, err
-			}
-			if instr != nil {
-				elseBody = append(elseBody, instr)
-			}
-		}
+		elseBody = p.parseBlock(lexer.END)
 	}
 
 	// Make sure we have an END token
 	if p.cur.Type != lexer.END {
-		return nil, fmt.Errorf("expected 'end' token, got %q at line %d", p.cur.Literal, p.cur.Line)
+		return nil, p.errorf("expected 'end' token, got %s", p.curText())
 	}
 	// Consume the END token
 	p.nextToken()
+	span.End = p.end
+
+	return &IfInstr{IfBody: ifBody, ElseBody: elseBody, Span: span}, nil
+}
+
+// parseTry parses `try ... rescue ... end`. Unlike else, the rescue branch
+// cannot be left out, though it may be empty.
+func (p *Parser) parseTry() (Instruction, error) {
+	span := p.span()
+	p.nextToken() // consume 'try'
+
+	body := p.parseBlock(lexer.RESCUE)
+	if p.cur.Type != lexer.RESCUE {
+		return nil, p.errorf("expected 'rescue' token, got %s", p.curText())
+	}
+	p.nextToken() // consume 'rescue'
 
-	return &IfInstr{IfBody: ifBody, ElseBody: elseBody}, nil
+	rescue := p.parseBlock(lexer.END)
+	if p.cur.Type != lexer.END {
+		return nil, p.errorf("expected 'end' token, got %s", p.curText())
+	}
+	p.nextToken() // consume 'end'
+	span.End = p.end
+
+	return &TryInstr{Body: body, Rescue: rescue, Span: span}, nil
+}
+
+// parseStitchCount parses the stitch count that ends a row, `(12)` or
+// `(12 sts)`.
+func (p *Parser) parseStitchCount() (Instruction, error) {
+	span := p.span()
+	line := p.cur.Line
+	p.nextToken() // consume '('
+	p.skipFillers()
+	if p.cur.Type != lexer.INT {
+		return nil, p.errorf("expected a stitch count, got %s", p.curText())
+	}
+	want, err := p.intLiteral()
+	if err != nil {
+		return nil, err
+	}
+	if want < 0 {
+		return nil, p.errorf("invalid stitch count %s", p.curText())
+	}
+	p.nextToken()
+	p.skipFillers()
+	if p.cur.Type != lexer.RPAREN {
+		return nil, p.errorf("expected ')' after the stitch count, got %s", p.curText())
+	}
+	p.nextToken()
+	span.End = p.end
+	switch p.cur.Type {
+	case lexer.EOF, lexer.RPAREN, lexer.RBRACKET, lexer.ASTERISK, lexer.END, lexer.ELSE, lexer.RESCUE:
+		// the end of a block ends the row too
+	default:
+		if p.cur.Line == line {
+			return nil, &Diagnostic{Pos: span.Start, Msg: "a stitch count must end its row"}
+		}
+	}
+	return &CountInstr{Row: p.rows[line], Want: want, Span: span}, nil
 }
 
 // parseRepeatBlock handles both * ... * and [ ... ] repeat blocks.
@@ -215,31 +527,21 @@ func (p *Parser) parseRepeatBlock() (Instruction, error) {
 		endToken = lexer.RBRACKET
 	}
 
-	ri := &RepeatInstr{}
+	ri := &RepeatInstr{Span: p.span()}
 	p.nextToken() // consume '*' or '['
 
-	for p.cur.Type != endToken && p.cur.Type != lexer.EOF {
-		p.skipFillers()
-		if p.cur.Type == endToken || p.cur.Type == lexer.EOF {
-			break
-		}
-		instr, err := p.parseInstruction()
-		if err != nil {
-			return nil, err
-		}
-		if instr != nil {
-			ri.Body = append(ri.Body, instr)
-		}
-	}
+	p.loops++
+	ri.Body = p.parseBlock(endToken)
+	p.loops--
 
 	if p.cur.Type != endToken {
-		return nil, fmt.Errorf("expected closing %q, got %q at line %d", endToken, p.cur.Literal, p.cur.Line)
+		return nil, p.errorf("expected closing %q, got %s", endToken, p.curText())
 	}
 	p.nextToken() // consume closing
 
 	p.skipFillers()
 	if p.cur.Type != lexer.REPEAT {
-		return nil, fmt.Errorf("expected 'repeat' after block, got %q at line %d", p.cur.Literal, p.cur.Line)
+		return nil, p.errorf("expected 'repeat' after block, got %s", p.curText())
 	}
 	p.nextToken() // consume 'repeat'
 
@@ -251,31 +553,45 @@ func (p *Parser) parseRepeatBlock() (Instruction, error) {
 
 	switch p.cur.Type {
 	case lexer.INT:
-		count, err := strconv.Atoi(p.cur.Literal)
-		if err != nil || count < 0 {
-			return nil, fmt.Errorf("invalid repeat count %q", p.cur.Literal)
+		count, err := p.intLiteral()
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, p.errorf("invalid repeat count %s", p.curText())
 		}
 		ri.Mode = RepeatCount
 		ri.Count = count
 		p.nextToken()
+		ri.End = p.end
 		p.skipFillers()
 	case lexer.UNTIL:
 		ri.Mode = RepeatUntil
 		p.nextToken()
+		ri.End = p.end
 	case lexer.WHILE:
 		ri.Mode = RepeatWhile
 		p.nextToken()
+		ri.End = p.end
+	case lexer.STACK:
+		ri.Mode = RepeatStack
+		p.nextToken()
+		ri.End = p.end
 	default:
-		return nil, fmt.Errorf("expected repeat count, 'until', or 'while', got %q at line %d", p.cur.Literal, p.cur.Line)
+		return nil, p.errorf("expected repeat count, 'until', 'while', or 'from stack', got %s", p.curText())
 	}
 
 	return ri, nil
 }
 
 func (p *Parser) parsePrefixedCount() (Instruction, error) {
-	count, err := strconv.Atoi(p.cur.Literal)
-	if err != nil || count < 0 {
-		return nil, fmt.Errorf("invalid count %q", p.cur.Literal)
+	span := p.span()
+	count, err := p.intLiteral()
+	if err != nil {
+		return nil, err
+	}
+	if count < 0 {
+		return nil, p.errorf("invalid count %s", p.curText())
 	}
 	p.nextToken()
 	p.skipFillers()
@@ -285,29 +601,76 @@ func (p *Parser) parsePrefixedCount() (Instruction, error) {
 		return nil, err
 	}
 	if instr == nil || !countableInstr(instr) {
-		return nil, fmt.Errorf("count prefix must apply to a stitch or stitch call")
+		return nil, &Diagnostic{Pos: span.Start, Msg: "count prefix must apply to a stitch or stitch call"}
 	}
-	return &RepeatInstr{Mode: RepeatCount, Count: count, Body: []Instruction{instr}}, nil
+	span.End = instr.EndPos()
+	return &RepeatInstr{Mode: RepeatCount, Count: count, Body: []Instruction{instr}, Span: span}, nil
 }
 
 func (p *Parser) parseSimpleWithOptionalCount() (Instruction, error) {
-	instr := &SimpleInstr{Token: p.cur.Literal}
+	instr := &SimpleInstr{Token: p.cur.Literal, Span: p.span()}
 	p.nextToken() // consume instruction token
+	instr.End = p.end
 	return p.wrapPostfixCount(instr)
 }
 
 func (p *Parser) wrapPostfixCount(instr Instruction) (Instruction, error) {
 	if p.cur.Type == lexer.INT && countableInstr(instr) {
-		count, err := strconv.Atoi(p.cur.Literal)
-		if err != nil || count < 0 {
-			return nil, fmt.Errorf("invalid count %q", p.cur.Literal)
+		count, err := p.intLiteral()
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, p.errorf("invalid count %s", p.curText())
 		}
 		p.nextToken()
-		return &RepeatInstr{Mode: RepeatCount, Count: count, Body: []Instruction{instr}}, nil
+		span := Span{Start: instr.Pos(), End: p.end}
+		return &RepeatInstr{Mode: RepeatCount, Count: count, Body: []Instruction{instr}, Span: span}, nil
 	}
 	return instr, nil
 }
 
+// intLiteral decodes the current INT token: a decimal with an optional minus
+// sign, a 0x or 0b literal, or a character literal such as 'A'. Values that do
+// not fit in an int are syntax errors.
+func (p *Parser) intLiteral() (int, error) {
+	lit := p.cur.Literal
+	if strings.HasPrefix(lit, "'") {
+		text, err := strconv.Unquote(lit)
+		if err != nil || utf8.RuneCountInString(text) != 1 {
+			return 0, p.errorf("malformed character %s: want exactly one character between single quotes", lit)
+		}
+		r, _ := utf8.DecodeRuneInString(text)
+		return int(r), nil
+	}
+	base := 10
+	if digits := strings.ToLower(strings.TrimPrefix(lit, "-")); strings.HasPrefix(digits, "0x") || strings.HasPrefix(digits, "0b") {
+		base = 0 // let ParseInt read the prefix
+	}
+	n, err := strconv.ParseInt(lit, base, strconv.IntSize)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, p.errorf("number %s is out of range (must fit in %d bits)", lit, strconv.IntSize)
+	}
+	if err != nil {
+		return 0, p.errorf("invalid number %s", lit)
+	}
+	return int(n), nil
+}
+
+// curText describes the current token for error messages.
+func (p *Parser) curText() string {
+	if p.cur.Type == lexer.EOF {
+		return "end of input"
+	}
+	return strconv.Quote(p.cur.Literal)
+}
+
+// span starts a node at the current token; the caller fills in End once the
+// node's last token has been consumed.
+func (p *Parser) span() Span {
+	return Span{Start: Pos{Line: p.cur.Line, Column: p.cur.Column, File: p.file}}
+}
+
 func (p *Parser) skipFillers() {
 	for p.cur.Type == lexer.FILLER {
 		p.nextToken()
@@ -327,7 +690,7 @@ func countableInstr(instr Instruction) bool {
 
 func isCountableOp(op string) bool {
 	switch op {
-	case "ch", "pick", "roll":
+	case "ch", "pick", "roll", "fo", "tally":
 		return false
 	default:
 		return true
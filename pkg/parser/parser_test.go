@@ -0,0 +1,102 @@
+package parser_test
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/svader0/yarnball/pkg/parser"
+)
+
+// TestErrorsReportedOnce checks that a syntax error is reported once, and not
+// again by each enclosing block that stops at the same token.
+func TestErrorsReportedOnce(t *testing.T) {
+	tests := []struct {
+		src  string
+		want int
+	}{
+		{"stitch a = ( ch 1 ]\nch 2", 1},
+		{"stitch a = ( ch 1 end", 1},
+		{"ch 1 if ch 2 ]", 1},
+		{"ch 1 ]\nch 2 )", 2},
+		{"ch x\nsc ]", 2},
+	}
+	for _, tt := range tests {
+		_, err := parser.ParseFile(nil, "", tt.src)
+		var errs parser.ErrorList
+		if !errors.As(err, &errs) {
+			t.Errorf("%q: got %v, want syntax errors", tt.src, err)
+			continue
+		}
+		if len(errs) != tt.want {
+			t.Errorf("%q: got %d errors, want %d:\n%v", tt.src, len(errs), tt.want, err)
+		}
+	}
+}
+
+// TestJoinParent checks that a join may climb out of the joining file's
+// directory, but not out of the file system it is read from.
+func TestJoinParent(t *testing.T) {
+	fsys := fstest.MapFS{
+		"lib/edges.yarn": {Data: []byte("stitch picot = ( ch 3 )")},
+	}
+	prog, err := parser.ParseFile(fsys, "patterns/scarf.yarn", `join pattern "../lib/edges.yarn" edges.picot`)
+	if err != nil {
+		t.Fatalf("join from a sibling directory: %v", err)
+	}
+	join := prog.Instructions[0].(*parser.JoinInstr)
+	if len(join.Body) != 1 || join.Body[0].(*parser.StitchDef).Name != "edges.picot" {
+		t.Errorf("joined %v, want the stitch edges.picot", join.Body)
+	}
+
+	_, err = parser.ParseFile(fsys, "patterns/scarf.yarn", `join pattern "../../lib/edges.yarn"`)
+	if err == nil || !strings.Contains(err.Error(), "leaves the directory") {
+		t.Errorf("join from outside the root: got %v, want it refused", err)
+	}
+}
+
+// TestJoinWithoutFS checks that a join is an error, not a crash, when there
+// is no file system to read it from.
+func TestJoinWithoutFS(t *testing.T) {
+	_, err := parser.ParseFile(nil, "", `join pattern "edges.yarn"`)
+	var errs parser.ErrorList
+	if !errors.As(err, &errs) || len(errs) != 1 {
+		t.Errorf("got %v, want one syntax error", err)
+	}
+}
+
+// TestFoStatus checks that fo only takes an exit status from its own row, and
+// only one a shell can report.
+func TestFoStatus(t *testing.T) {
+	tests := []struct {
+		src  string
+		args []string // of the fo, or nil for a syntax error
+	}{
+		{"ch 1 fo", []string{}},
+		{"ch 1 fo 3", []string{"3"}},
+		{"ch 1 fo 125", []string{"125"}},
+		{"Row 1: ch 1 fo\nRow 2: 3 sc", []string{}},
+		{"ch 1 fo 126", nil},
+		{"ch 1 fo 300", nil},
+		{"ch 1 fo -1", nil},
+	}
+	for _, tt := range tests {
+		prog, err := parser.ParseFile(nil, "", tt.src)
+		if tt.args == nil {
+			if err == nil {
+				t.Errorf("%q: parsed, want an error for the status", tt.src)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+			continue
+		}
+		fo := prog.Instructions[1].(*parser.SimpleInstr)
+		if !slices.Equal(fo.Args, tt.args) {
+			t.Errorf("%q: got status %q, want %q", tt.src, fo.Args, tt.args)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package parser
+
+import "fmt"
+
+// Resolve hoists every stitch definition in prog, however deeply nested, into
+// prog.Stitches, so stitches may be called before (or from within) the rows
+// that define them. It then checks every call against those definitions and
+// reports undefined or duplicate stitch names as an ErrorList, before anything
+// runs. Names for which known returns true count as defined even without a
+// definition in prog (e.g. stitches from earlier REPL input); known may be nil.
+func Resolve(prog *Program, known func(name string) bool) error {
+	var errs ErrorList
+	defs := make(map[string]*StitchDef)
+	prog.Stitches = nil
+
+	walk(prog.Instructions, func(instr Instruction) {
+		def, ok := instr.(*StitchDef)
+		if !ok {
+			return
+		}
+		if prev, exists := defs[def.Name]; exists {
+			errs = append(errs, &Diagnostic{Pos: def.Pos(), Msg: fmt.Sprintf("stitch %q is already defined at %s", def.Name, prev.Pos())})
+			return
+		}
+		defs[def.Name] = def
+		prog.Stitches = append(prog.Stitches, def)
+	})
+
+	walk(prog.Instructions, func(instr Instruction) {
+		call, ok := instr.(*CallInstr)
+		if !ok {
+			return
+		}
+		if _, exists := defs[call.Name]; exists || (known != nil && known(call.Name)) {
+			return
+		}
+		errs = append(errs, &Diagnostic{Pos: call.Pos(), Msg: fmt.Sprintf("undefined stitch %q", call.Name)})
+	})
+
+	errs.Sort()
+	return errs.Err()
+}
+
+// walk calls fn for every instruction in instrs, depth first, including those
+// nested inside repeats, conditionals, stitch definitions and joined patterns.
+func walk(instrs []Instruction, fn func(Instruction)) {
+	for _, instr := range instrs {
+		fn(instr)
+		switch node := instr.(type) {
+		case *RepeatInstr:
+			walk(node.Body, fn)
+		case *StitchDef:
+			walk(node.Body, fn)
+		case *IfInstr:
+			walk(node.IfBody, fn)
+			walk(node.ElseBody, fn)
+		case *TryInstr:
+			walk(node.Body, fn)
+			walk(node.Rescue, fn)
+		case *JoinInstr:
+			walk(node.Body, fn)
+		}
+	}
+}
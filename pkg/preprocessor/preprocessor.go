@@ -16,9 +16,10 @@ func New() *Preprocessor {
 
 func (p *Preprocessor) Process(input string) (string, error) {
 	lines := strings.Split(input, "\n")
-	var processedLines []string
+	processedLines := make([]string, 0, len(lines))
 
-	// Remove everything before and including the line that says "STITCH GUIDE:" (case-insensitive).
+	// Blank out everything before and including the line that says "STITCH GUIDE:" (case-insensitive).
+	// The lines are kept (empty) so that line numbers still match the original file.
 	var startIdx int
 	for i, line := range lines {
 		trimmed := strings.TrimSpace(line)
@@ -31,35 +32,30 @@ func (p *Preprocessor) Process(input string) (string, error) {
 			break
 		}
 	}
+	for range lines[:startIdx] {
+		processedLines = append(processedLines, "")
+	}
 
 	for _, line := range lines[startIdx:] {
 
-		// Commas are just to make things look nice, currently serve no other purpose---ignore them.
-		line = strings.ReplaceAll(line, ",", "")
-		line = strings.TrimSpace(line)
+		// Remove any comments from the line
+		line = p.removeComment(line)
+
+		// Commas are just to make things look nice, currently serve no other purpose---blank them out.
+		// Everything below replaces text with spaces rather than deleting it, so columns are preserved.
+		// Text inside string and character literals is left exactly as written.
+		line = mapUnquoted(line, func(s string) string { return strings.ReplaceAll(s, ",", " ") })
 
 		// If the line is empty, a comment, or exactly "INSTRUCTIONS:" leave an empty line to preserve line numbers.
-		if line == "" || strings.HasPrefix(line, "#") || strings.EqualFold(line, "INSTRUCTIONS:") {
+		// "INSTRUCTIONS:" is just our label to separate the stitch guide (functions) from the actual instructions.
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.EqualFold(trimmed, "INSTRUCTIONS:") {
 			processedLines = append(processedLines, "")
 			continue
 		}
 
-		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
-			continue // Skip empty lines and comment lines
-		}
-		// If the line says "INSTRUCTIONS:", skip it --- that's just our label to separate the stitch guide (functions) from the actual instructions.
-		if strings.EqualFold(strings.TrimSpace(line), "INSTRUCTIONS:") {
-			continue
-		}
-
-		// Remove any comments from the line
-		line = p.removeComment(line)
-
-		// Remove "Row #:" or "Round #:" prefixes if present
-		line = p.RemoveRowRoundPrefix(line)
-
 		// convert to lowercase
-		line = strings.ToLower(line)
+		line = mapUnquoted(line, strings.ToLower)
 
 		processedLines = append(processedLines, line)
 	}
@@ -68,21 +64,50 @@ func (p *Preprocessor) Process(input string) (string, error) {
 }
 
 func (p *Preprocessor) removeComment(line string) string {
-	// Check if the line contains a comment
-	if idx := strings.Index(line, "#"); idx != -1 {
-		return strings.TrimSpace(line[:idx]) // Return the line up to the comment
+	// Check if the line contains a comment; a '#' inside a string or character literal doesn't count
+	for i := 0; i < len(line); i++ {
+		if isQuote(line[i]) {
+			i = closingQuote(line, i) - 1
+		} else if line[i] == '#' {
+			line = line[:i] // Keep the line up to the comment
+			break
+		}
 	}
-	return line
+	return strings.TrimRight(line, " \t\r")
 }
 
-// RemoveRowRoundPrefix removes the "Row N:" or "Round N:" prefix from a line if it exists.
-// We don't need those, they just add a little crochet-inspired flair to the code.
-func (p *Preprocessor) RemoveRowRoundPrefix(line string) string {
-	if strings.HasPrefix(line, "Row ") || strings.HasPrefix(line, "Round ") {
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) > 1 {
-			return strings.TrimSpace(parts[1]) // Return the part after the colon
+// mapUnquoted applies f to the parts of line outside string and character literals.
+func mapUnquoted(line string, f func(string) string) string {
+	var b strings.Builder
+	start := 0
+	for i := 0; i < len(line); i++ {
+		if !isQuote(line[i]) {
+			continue
 		}
+		end := closingQuote(line, i)
+		b.WriteString(f(line[start:i]))
+		b.WriteString(line[i:end])
+		start = end
+		i = end - 1
 	}
-	return line
+	b.WriteString(f(line[start:]))
+	return b.String()
+}
+
+// closingQuote returns the index just past the literal whose opening quote is
+// at line[open], or len(line) if the literal is never closed.
+func closingQuote(line string, open int) int {
+	for i := open + 1; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case line[open]:
+			return i + 1
+		}
+	}
+	return len(line)
+}
+
+func isQuote(ch byte) bool {
+	return ch == '"' || ch == '\''
 }
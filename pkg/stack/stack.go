@@ -3,49 +3,53 @@ package stack
 import "fmt"
 
 /*
-	A simple stack implementation for use in the Yarnball interpreter.
+	A simple stack implementation for use in the Yarnball interpreter. It holds
+	ints by default, or *big.Ints when a pattern runs with big integers.
 */
 
-type Stack struct {
-	items []int
+type Stack[T any] struct {
+	items []T
 }
 
-func New() *Stack {
-	return &Stack{
-		items: []int{},
+func New[T any]() *Stack[T] {
+	return &Stack[T]{
+		items: []T{},
 	}
 }
 
-func (s *Stack) Push(item int) {
+func (s *Stack[T]) Push(item T) {
 	s.items = append(s.items, item)
 }
 
-func (s *Stack) Pop() (int, error) {
+func (s *Stack[T]) Pop() (T, error) {
 	if len(s.items) == 0 {
-		return 0, fmt.Errorf("stack underflow")
+		var zero T
+		return zero, fmt.Errorf("stack underflow")
 	}
 	item := s.items[len(s.items)-1]
 	s.items = s.items[:len(s.items)-1]
 	return item, nil
 }
 
-func (s *Stack) Peek() (int, bool) {
+func (s *Stack[T]) Peek() (T, bool) {
 	if len(s.items) == 0 {
-		return 0, false // Stack is empty
+		var zero T
+		return zero, false // Stack is empty
 	}
 	return s.items[len(s.items)-1], true
 }
 
 // PeekAt returns the value depth elements from the top (0 = top).
-func (s *Stack) PeekAt(depth int) (int, error) {
+func (s *Stack[T]) PeekAt(depth int) (T, error) {
 	if depth < 0 || depth >= len(s.items) {
-		return 0, fmt.Errorf("stack underflow")
+		var zero T
+		return zero, fmt.Errorf("stack underflow")
 	}
 	return s.items[len(s.items)-1-depth], nil
 }
 
 // Roll moves the value at depth to the top (0 = no-op).
-func (s *Stack) Roll(depth int) error {
+func (s *Stack[T]) Roll(depth int) error {
 	if depth < 0 || depth >= len(s.items) {
 		return fmt.Errorf("stack underflow")
 	}
@@ -59,14 +63,27 @@ func (s *Stack) Roll(depth int) error {
 	return nil
 }
 
-func (s *Stack) IsEmpty() bool {
+func (s *Stack[T]) IsEmpty() bool {
 	return len(s.items) == 0
 }
 
-func (s *Stack) Size() int {
+func (s *Stack[T]) Size() int {
 	return len(s.items)
 }
 
-func (s *Stack) Clear() {
-	s.items = []int{}
+// Items returns a copy of the stack contents, bottom first.
+func (s *Stack[T]) Items() []T {
+	items := make([]T, len(s.items))
+	copy(items, s.items)
+	return items
+}
+
+// Set replaces the stack contents with items, bottom first. The stack keeps
+// items, so the caller must not modify it afterwards.
+func (s *Stack[T]) Set(items []T) {
+	s.items = items
+}
+
+func (s *Stack[T]) Clear() {
+	s.items = []T{}
 }
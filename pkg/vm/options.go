@@ -0,0 +1,55 @@
+package vm
+
+import (
+	"bufio"
+	"io"
+)
+
+// Option configures a Machine at construction time.
+type Option func(*Machine)
+
+// WithOutput sets the writer that `pic` and `yo` print to (os.Stdout by default).
+// Output is buffered and flushed whenever Run returns or input is read.
+func WithOutput(w io.Writer) Option {
+	return func(m *Machine) {
+		// bufio.NewWriter reuses w when it is already a *bufio.Writer.
+		m.out = bufio.NewWriter(w)
+	}
+}
+
+// WithInput sets the reader that input stitches read from (os.Stdin by default).
+func WithInput(r io.Reader) Option {
+	return func(m *Machine) {
+		// bufio.NewReader reuses r when it is already a *bufio.Reader.
+		m.in = bufio.NewReader(r)
+	}
+}
+
+// WithMemoryLimit sets the most cells the skein may hold (1<<20 by default).
+func WithMemoryLimit(cells int) Option {
+	return func(m *Machine) {
+		if cells > 0 {
+			m.memLimit = cells
+		}
+	}
+}
+
+// WithLifelineLimit sets the most cells the lifelines of a pattern may hold
+// between them (1<<22 by default). A lifeline holds a copy of every stack, the
+// global markers and the skein.
+func WithLifelineLimit(cells int) Option {
+	return func(m *Machine) {
+		if cells > 0 {
+			m.lineLimit = cells
+		}
+	}
+}
+
+// WithStepLimit sets the maximum number of steps a single Run may take.
+func WithStepLimit(limit int) Option {
+	return func(m *Machine) {
+		if limit > 0 {
+			m.stepLimit = limit
+		}
+	}
+}
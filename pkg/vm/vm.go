@@ -0,0 +1,760 @@
+package vm
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/svader0/yarnball/pkg/compiler"
+	"github.com/svader0/yarnball/pkg/evaluator"
+)
+
+/*
+	A stack machine that executes bytecode produced by the compiler package.
+	It follows the tree-walking evaluator exactly: the same stitch semantics,
+	the same step limit, and the same error types (from the evaluator package).
+*/
+
+// ctxCheckInterval is how many steps run between checks for cancellation.
+const ctxCheckInterval = 1024
+
+// loop is the state of a repeat in progress.
+type loop struct {
+	left int // passes still to start; unused by `repeat while` and `repeat until`
+	pass int // passes finished before the current one
+}
+
+// handler is a try block in progress: where its rescue branch starts, and the
+// calls and repeats to unwind to when it catches an error.
+type handler struct {
+	rescue int
+	frames int
+	loops  int
+}
+
+type frame struct {
+	call    int         // address of the OpCall; execution resumes just after it
+	markers map[int]int // markers placed by this call; nil until the first pm
+}
+
+// lifeline is a checkpoint recorded by OpLifeline. Markers local to a stitch
+// call are not part of it, as in the evaluator.
+type lifeline struct {
+	stacks  [][]int
+	color   int
+	markers []int
+	placed  []bool
+	skein   []int
+	size    int
+}
+
+// Machine holds the state of one run of a compiled program. A Machine must not
+// be shared between goroutines; create one per run instead, since the program
+// it executes is read-only.
+type Machine struct {
+	prog      *compiler.Program
+	stack     []int   // the stack of the colour being worked
+	stacks    [][]int // every colour's stack, indexed like prog.Colors; stale for the colour being worked
+	color     int     // the colour being worked
+	changed   bool    // set by the first colour instruction; errors name colours from then on
+	loops     []loop  // repeats in progress, innermost last
+	frames    []frame
+	handlers  []handler // try blocks in progress, innermost last
+	markers   []int     // global stitch markers, indexed like prog.Markers
+	placed    []bool    // whether each global marker has been placed
+	skein     []int
+	memLimit  int
+	lines     []lifeline // checkpoints to frog back to, most recent last
+	lineLimit int
+	retained  int // cells held by lines
+	stepLimit int
+	steps     int
+	out       *bufio.Writer
+	in        *bufio.Reader
+}
+
+func New(prog *compiler.Program, opts ...Option) *Machine {
+	m := &Machine{
+		prog:      prog,
+		markers:   make([]int, len(prog.Markers)),
+		placed:    make([]bool, len(prog.Markers)),
+		stacks:    make([][]int, len(prog.Colors)),
+		stepLimit: 1_000_000,
+		memLimit:  evaluator.DefaultMemoryLimit,
+		lineLimit: evaluator.DefaultLifelineLimit,
+		out:       bufio.NewWriter(os.Stdout),
+		in:        bufio.NewReader(os.Stdin),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Stack returns a copy of the stack contents, bottom first.
+func (m *Machine) Stack() []int {
+	return slices.Clone(m.stack)
+}
+
+// Flush writes any buffered output to the underlying writer.
+func (m *Machine) Flush() error {
+	return m.out.Flush()
+}
+
+// Run executes the program until it ends, halts with `fo` (returning an
+// *evaluator.HaltError), fails, or ctx is done. Errors are the same types the
+// evaluator returns.
+func (m *Machine) Run(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("evaluation not started: %w", err)
+	}
+	m.steps = 0
+	m.loops = m.loops[:0]
+	m.frames = m.frames[:0]
+	m.handlers = m.handlers[:0]
+	err := m.run(ctx, 0)
+	for err != nil {
+		pc, ok := m.rescue(err)
+		if !ok {
+			break
+		}
+		err = m.run(ctx, pc)
+	}
+	if flushErr := m.Flush(); err == nil && flushErr != nil {
+		return fmt.Errorf("flushing output: %w", flushErr)
+	}
+	return err
+}
+
+// rescue hands err to the innermost try block, if it catches it: it unwinds to
+// the block, pushes the error code and returns the address of the rescue
+// branch.
+func (m *Machine) rescue(err error) (int, bool) {
+	code, ok := evaluator.ErrorCode(err)
+	if !ok || len(m.handlers) == 0 {
+		return 0, false
+	}
+	h := m.handlers[len(m.handlers)-1]
+	m.handlers = m.handlers[:len(m.handlers)-1]
+	m.frames, m.loops = m.frames[:h.frames], m.loops[:h.loops]
+	m.stack = append(m.stack, code)
+	return h.rescue, true
+}
+
+// run executes the program from pc until it ends or fails.
+func (m *Machine) run(ctx context.Context, pc int) (err error) {
+	// The hot loop works on locals; they are written back to m before anything
+	// that looks at the machine (errors, calls into helpers) and on exit.
+	code := m.prog.Code
+	st := m.stack
+	steps, limit := m.steps, m.stepLimit
+	defer func() {
+		m.stack = st
+		m.steps = steps
+	}()
+	for ; ; pc++ {
+		in := code[pc]
+		if in.Op.Counted() {
+			steps++
+			if limit > 0 && steps > limit {
+				m.stack, m.steps = st, steps
+				return &evaluator.StepLimitError{RuntimeError: m.context(pc), Limit: limit}
+			}
+			if steps%ctxCheckInterval == 0 {
+				select {
+				case <-ctx.Done():
+					m.stack = st
+					return m.fail(pc, fmt.Errorf("evaluation stopped after %d steps: %w", steps, ctx.Err()))
+				default:
+				}
+			}
+		}
+		switch in.Op {
+		case compiler.OpPush:
+			st = append(st, in.Arg)
+		case compiler.OpPop:
+			if len(st) < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			st = st[:len(st)-1]
+		case compiler.OpDup:
+			if len(st) < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			st = append(st, st[len(st)-1])
+		case compiler.OpSwap:
+			if len(st) < 2 {
+				m.stack = st
+				return m.underflow(pc, 2)
+			}
+			n := len(st)
+			st[n-1], st[n-2] = st[n-2], st[n-1]
+		case compiler.OpOver:
+			if len(st) < 2 {
+				m.stack = st
+				return m.underflow(pc, 2)
+			}
+			st = append(st, st[len(st)-2])
+		case compiler.OpPick:
+			if in.Arg < 0 || in.Arg >= len(st) {
+				m.stack = st
+				return m.underflow(pc, min(in.Arg, math.MaxInt-1)+1)
+			}
+			st = append(st, st[len(st)-1-in.Arg])
+		case compiler.OpRoll:
+			if in.Arg < 0 || in.Arg >= len(st) {
+				m.stack = st
+				return m.underflow(pc, min(in.Arg, math.MaxInt-1)+1)
+			}
+			idx := len(st) - 1 - in.Arg
+			val := st[idx]
+			copy(st[idx:], st[idx+1:])
+			st[len(st)-1] = val
+		case compiler.OpInc:
+			if len(st) < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			st[len(st)-1]++
+		case compiler.OpDec:
+			if len(st) < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			st[len(st)-1]--
+		case compiler.OpAdd:
+			n := len(st)
+			if n < 2 {
+				m.stack = st
+				return m.underflow(pc, 2)
+			}
+			st[n-2] += st[n-1]
+			st = st[:n-1]
+		case compiler.OpSub:
+			n := len(st)
+			if n < 2 {
+				m.stack = st
+				return m.underflow(pc, 2)
+			}
+			st[n-2] -= st[n-1]
+			st = st[:n-1]
+		case compiler.OpMul:
+			n := len(st)
+			if n < 2 {
+				m.stack = st
+				return m.underflow(pc, 2)
+			}
+			st[n-2] *= st[n-1]
+			st = st[:n-1]
+		case compiler.OpDiv, compiler.OpMod:
+			n := len(st)
+			if n < 2 {
+				m.stack = st
+				return m.underflow(pc, 2)
+			}
+			if st[n-1] == 0 {
+				m.stack = st
+				return &evaluator.DivisionByZeroError{RuntimeError: m.context(pc)}
+			}
+			if in.Op == compiler.OpDiv {
+				st[n-2] /= st[n-1]
+			} else {
+				st[n-2] %= st[n-1]
+			}
+			st = st[:n-1]
+		case compiler.OpGt, compiler.OpLt, compiler.OpEq, compiler.OpNeq:
+			n := len(st)
+			if n < 2 {
+				m.stack = st
+				return m.underflow(pc, 2)
+			}
+			st[n-2] = compare(in.Op, st[n-2], st[n-1])
+			st = st[:n-1]
+		case compiler.OpAnd, compiler.OpOr, compiler.OpXor, compiler.OpLogAnd, compiler.OpLogOr:
+			n := len(st)
+			if n < 2 {
+				m.stack = st
+				return m.underflow(pc, 2)
+			}
+			st[n-2] = bitwise(in.Op, st[n-2], st[n-1])
+			st = st[:n-1]
+		case compiler.OpShl, compiler.OpShr:
+			n := len(st)
+			if n < 2 {
+				m.stack = st
+				return m.underflow(pc, 2)
+			}
+			if st[n-1] < 0 {
+				m.stack = st
+				return m.fail(pc, fmt.Errorf("negative shift count %d", st[n-1]))
+			}
+			if in.Op == compiler.OpShl {
+				st[n-2] <<= st[n-1]
+			} else {
+				st[n-2] >>= st[n-1]
+			}
+			st = st[:n-1]
+		case compiler.OpNot:
+			if len(st) < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			st[len(st)-1] = ^st[len(st)-1]
+		case compiler.OpLogNot:
+			if len(st) < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			st[len(st)-1] = truth(st[len(st)-1] == 0)
+		case compiler.OpRot:
+			// ( n1 n2 n3 — n2 n3 n1 )
+			n := len(st)
+			if n < 3 {
+				m.stack = st
+				return m.underflow(pc, 3)
+			}
+			st[n-3], st[n-2], st[n-1] = st[n-2], st[n-1], st[n-3]
+		case compiler.OpPutChar:
+			if len(st) < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			m.putChar(st[len(st)-1])
+			st = st[:len(st)-1]
+		case compiler.OpPutInt:
+			if len(st) < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			m.out.Write(strconv.AppendInt(m.out.AvailableBuffer(), int64(st[len(st)-1]), 10))
+			m.out.WriteByte('\n')
+			st = st[:len(st)-1]
+		case compiler.OpString:
+			// last character first, then the count; see parser.StringInstr
+			s := m.prog.Strings[in.Arg]
+			n := 0
+			for i := len(s); i > 0; n++ {
+				r, size := utf8.DecodeLastRuneInString(s[:i])
+				st = append(st, int(r))
+				i -= size
+			}
+			st = append(st, n)
+		case compiler.OpPutStr:
+			if len(st) < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			n := st[len(st)-1]
+			if n < 0 {
+				m.stack = st
+				return m.fail(pc, fmt.Errorf("negative string length %d", n))
+			}
+			if n >= len(st) {
+				m.stack = st
+				return m.underflow(pc, n+1)
+			}
+			st = st[:len(st)-1]
+			for ; n > 0; n-- {
+				m.putChar(st[len(st)-1])
+				st = st[:len(st)-1]
+			}
+		case compiler.OpReadChar, compiler.OpReadInt:
+			m.stack = st
+			n, err := m.read(in.Op)
+			if err != nil {
+				return m.fail(pc, err)
+			}
+			st = append(st, n)
+		case compiler.OpHalt:
+			return &evaluator.HaltError{Code: in.Arg}
+		case compiler.OpDefine, compiler.OpJoin:
+			// only here to take a step
+		case compiler.OpCall:
+			stitch := &m.prog.Stitches[in.Arg]
+			f := frame{call: pc}
+			if n := len(stitch.Params); n > 0 {
+				if len(st) < n {
+					m.stack = st
+					return m.underflowParams(pc, stitch.Params)
+				}
+				f.markers = make(map[int]int, n)
+				for i, idx := range stitch.Params {
+					f.markers[idx] = st[len(st)-n+i]
+				}
+				st = st[:len(st)-n]
+			}
+			m.frames = append(m.frames, f)
+			pc = stitch.Entry - 1
+		case compiler.OpIf:
+			n := len(st)
+			if n < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			cond := st[n-1]
+			st = st[:n-1]
+			if cond == 0 {
+				pc = in.Arg - 1
+			}
+		case compiler.OpRepeat:
+			m.loops = append(m.loops, loop{left: in.Arg, pass: -1})
+		case compiler.OpRepeatStack:
+			if len(st) < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			n := st[len(st)-1]
+			st = st[:len(st)-1]
+			if n < 0 {
+				m.stack = st
+				return m.fail(pc, fmt.Errorf("negative repeat count %d", n))
+			}
+			m.loops = append(m.loops, loop{left: n, pass: -1})
+		case compiler.OpBeginRepeat:
+			m.loops = append(m.loops, loop{pass: -1})
+		case compiler.OpLoop:
+			l := &m.loops[len(m.loops)-1]
+			if l.left == 0 {
+				m.loops = m.loops[:len(m.loops)-1]
+				pc = in.Arg - 1
+				break
+			}
+			l.left--
+			l.pass++
+		case compiler.OpWhile, compiler.OpUntil:
+			if len(st) < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			if (st[len(st)-1] == 0) == (in.Op == compiler.OpWhile) {
+				m.loops = m.loops[:len(m.loops)-1]
+				pc = in.Arg - 1
+				break
+			}
+			m.loops[len(m.loops)-1].pass++
+		case compiler.OpTally:
+			st = append(st, m.loops[len(m.loops)-1].pass)
+		case compiler.OpJump:
+			pc = in.Arg - 1
+		case compiler.OpPlaceMarker, compiler.OpPlaceGlobal:
+			if len(st) < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			n := st[len(st)-1]
+			st = st[:len(st)-1]
+			if in.Op == compiler.OpPlaceMarker && len(m.frames) > 0 {
+				f := &m.frames[len(m.frames)-1]
+				if f.markers == nil {
+					f.markers = make(map[int]int)
+				}
+				f.markers[in.Arg] = n
+				break
+			}
+			m.markers[in.Arg] = n
+			m.placed[in.Arg] = true
+		case compiler.OpSlipMarker, compiler.OpSlipGlobal:
+			if in.Op == compiler.OpSlipMarker && len(m.frames) > 0 {
+				if n, ok := m.frames[len(m.frames)-1].markers[in.Arg]; ok {
+					st = append(st, n)
+					break
+				}
+			}
+			if !m.placed[in.Arg] {
+				m.stack = st
+				return &evaluator.UndefinedMarkerError{RuntimeError: m.context(pc), Name: m.prog.Markers[in.Arg]}
+			}
+			st = append(st, m.markers[in.Arg])
+		case compiler.OpChangeColor:
+			m.changed = true
+			m.stacks[m.color] = st
+			m.color = in.Arg
+			st = m.stacks[in.Arg]
+		case compiler.OpCarry:
+			m.changed = true
+			if len(st) < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			if in.Arg != m.color {
+				m.stacks[in.Arg] = append(m.stacks[in.Arg], st[len(st)-1])
+				st = st[:len(st)-1]
+			}
+		case compiler.OpPickUp:
+			m.changed = true
+			if in.Arg == m.color {
+				if len(st) < 1 {
+					m.stack = st
+					return m.underflow(pc, 1)
+				}
+				break
+			}
+			other := m.stacks[in.Arg]
+			if len(other) < 1 {
+				m.stack = st
+				// the other colour ran out, so the error shows its stack
+				rt := m.context(pc)
+				rt.Color, rt.Stack = m.prog.Colors[in.Arg], nil
+				return &evaluator.StackUnderflowError{RuntimeError: rt, Need: 1, Have: 0}
+			}
+			st = append(st, other[len(other)-1])
+			m.stacks[in.Arg] = other[:len(other)-1]
+		case compiler.OpWind:
+			if len(st) < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			n := st[len(st)-1]
+			st = st[:len(st)-1]
+			if n < 0 {
+				m.stack = st
+				return m.fail(pc, fmt.Errorf("cannot wind a negative number of cells (%d)", n))
+			}
+			if n > m.memLimit-len(m.skein) {
+				m.stack = st
+				return &evaluator.MemoryLimitError{RuntimeError: m.context(pc), Want: n, Limit: m.memLimit}
+			}
+			st = append(st, len(m.skein))
+			m.skein = append(m.skein, make([]int, n)...)
+		case compiler.OpStash:
+			if len(st) < 2 {
+				m.stack = st
+				return m.underflow(pc, 2)
+			}
+			addr := st[len(st)-1]
+			st = st[:len(st)-1]
+			if addr < 0 || addr >= len(m.skein) {
+				m.stack = st
+				return m.address(pc, addr)
+			}
+			m.skein[addr] = st[len(st)-1]
+			st = st[:len(st)-1]
+		case compiler.OpUnstash:
+			if len(st) < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			addr := st[len(st)-1]
+			if addr < 0 || addr >= len(m.skein) {
+				st = st[:len(st)-1]
+				m.stack = st
+				return m.address(pc, addr)
+			}
+			st[len(st)-1] = m.skein[addr]
+		case compiler.OpMeasure:
+			st = append(st, len(m.skein))
+		case compiler.OpLifeline:
+			m.stacks[m.color] = st
+			if err := m.lifeline(pc); err != nil {
+				return err
+			}
+		case compiler.OpFrog:
+			if len(m.lines) == 0 {
+				m.stack = st
+				return m.fail(pc, fmt.Errorf("no lifeline to frog back to"))
+			}
+			l := m.pullOut()
+			m.stacks, m.color = l.stacks, l.color
+			m.markers, m.placed, m.skein = l.markers, l.placed, l.skein
+			st = m.stacks[m.color]
+		case compiler.OpPullOut:
+			if len(m.lines) == 0 {
+				m.stack = st
+				return m.fail(pc, fmt.Errorf("no lifeline to pull out"))
+			}
+			m.pullOut()
+		case compiler.OpSnip, compiler.OpSkip:
+			pc = in.Arg - 1
+		case compiler.OpDropLoop:
+			m.loops = m.loops[:len(m.loops)-1]
+		case compiler.OpTry:
+			m.handlers = append(m.handlers, handler{rescue: in.Arg, frames: len(m.frames), loops: len(m.loops)})
+		case compiler.OpEndTry:
+			m.handlers = m.handlers[:len(m.handlers)-1]
+			pc = in.Arg - 1
+		case compiler.OpDropTry:
+			m.handlers = m.handlers[:len(m.handlers)-1]
+		case compiler.OpCount:
+			if count := m.prog.Counts[in.Arg]; len(st) != count.Want {
+				m.stack = st
+				return &evaluator.StitchCountError{RuntimeError: m.context(pc), Row: count.Row, Want: count.Want, Have: len(st)}
+			}
+		case compiler.OpSnag:
+			if len(st) < 1 {
+				m.stack = st
+				return m.underflow(pc, 1)
+			}
+			code := st[len(st)-1]
+			st = st[:len(st)-1]
+			m.stack = st
+			return &evaluator.SnagError{RuntimeError: m.context(pc), Code: code}
+		case compiler.OpReturn, compiler.OpTieOff:
+			if len(m.frames) == 0 {
+				return nil
+			}
+			pc = m.frames[len(m.frames)-1].call
+			m.frames = m.frames[:len(m.frames)-1]
+		default:
+			m.stack = st
+			return m.fail(pc, fmt.Errorf("unknown opcode %d", in.Op))
+		}
+	}
+}
+
+// compare implements the comparison stitches, pushing 1 for true and 0 for false.
+func compare(op compiler.Opcode, second, top int) int {
+	switch op {
+	case compiler.OpGt:
+		return truth(second > top)
+	case compiler.OpLt:
+		return truth(second < top)
+	case compiler.OpEq:
+		return truth(second == top)
+	default: // compiler.OpNeq
+		return truth(second != top)
+	}
+}
+
+// bitwise implements the two-operand bitwise and logical stitches.
+func bitwise(op compiler.Opcode, second, top int) int {
+	switch op {
+	case compiler.OpAnd:
+		return second & top
+	case compiler.OpOr:
+		return second | top
+	case compiler.OpXor:
+		return second ^ top
+	case compiler.OpLogAnd:
+		return truth(second != 0 && top != 0)
+	default: // compiler.OpLogOr
+		return truth(second != 0 || top != 0)
+	}
+}
+
+func truth(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// lifeline records a checkpoint. m.stacks must be up to date for the colour
+// being worked.
+func (m *Machine) lifeline(pc int) error {
+	size := len(m.skein)
+	for _, s := range m.stacks {
+		size += len(s)
+	}
+	for _, p := range m.placed {
+		if p {
+			size++
+		}
+	}
+	if size > m.lineLimit-m.retained {
+		m.stack = m.stacks[m.color]
+		return &evaluator.LifelineLimitError{RuntimeError: m.context(pc), Want: size, Retained: m.retained, Limit: m.lineLimit}
+	}
+	l := lifeline{
+		stacks:  make([][]int, len(m.stacks)),
+		color:   m.color,
+		markers: slices.Clone(m.markers),
+		placed:  slices.Clone(m.placed),
+		skein:   slices.Clone(m.skein),
+		size:    size,
+	}
+	for i, s := range m.stacks {
+		l.stacks[i] = slices.Clone(s)
+	}
+	m.lines = append(m.lines, l)
+	m.retained += size
+	return nil
+}
+
+// pullOut removes the most recent lifeline and returns it.
+func (m *Machine) pullOut() lifeline {
+	l := m.lines[len(m.lines)-1]
+	m.lines = m.lines[:len(m.lines)-1]
+	m.retained -= l.size
+	return l
+}
+
+// read implements the input stitches: one character for OpReadChar, one
+// whitespace-separated integer for OpReadInt, or -1 at end of input.
+func (m *Machine) read(op compiler.Opcode) (int, error) {
+	if err := m.Flush(); err != nil {
+		return 0, err
+	}
+	if op == compiler.OpReadChar {
+		r, _, err := m.in.ReadRune()
+		if err == io.EOF {
+			return -1, nil
+		}
+		return int(r), err
+	}
+	var n int
+	if _, err := fmt.Fscan(m.in, &n); err == io.EOF {
+		return -1, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("invalid number: %w", err)
+	}
+	return n, nil
+}
+
+// putChar prints n the way fmt's %c verb does.
+func (m *Machine) putChar(n int) {
+	r := utf8.RuneError
+	if n >= 0 && n <= utf8.MaxRune {
+		r = rune(n)
+	}
+	m.out.WriteRune(r)
+}
+
+// context captures the machine state for an error raised at pc.
+func (m *Machine) context(pc int) evaluator.RuntimeError {
+	trace := make([]evaluator.Frame, len(m.frames))
+	for i, f := range m.frames {
+		trace[i] = evaluator.Frame{Stitch: m.prog.OpName(f.call), Pos: m.prog.Pos[f.call]}
+	}
+	rt := evaluator.RuntimeError{
+		Op:    m.prog.OpName(pc),
+		Pos:   m.prog.Pos[pc],
+		Stack: m.Stack(),
+		Trace: trace,
+	}
+	if m.changed {
+		rt.Color = m.prog.Colors[m.color]
+	}
+	return rt
+}
+
+// fail wraps err in an *evaluator.RuntimeError raised at pc.
+func (m *Machine) fail(pc int, err error) error {
+	rt := m.context(pc)
+	rt.Err = err
+	return &rt
+}
+
+func (m *Machine) address(pc, addr int) error {
+	return &evaluator.AddressError{RuntimeError: m.context(pc), Addr: addr, Size: len(m.skein)}
+}
+
+// underflowParams reports a call with too few values for the stitch's parameters.
+func (m *Machine) underflowParams(pc int, params []int) error {
+	names := make([]string, len(params))
+	for i, idx := range params {
+		names[i] = m.prog.Markers[idx]
+	}
+	return &evaluator.StackUnderflowError{RuntimeError: m.context(pc), Need: len(params), Have: len(m.stack), Params: names}
+}
+
+func (m *Machine) underflow(pc, need int) error {
+	return &evaluator.StackUnderflowError{RuntimeError: m.context(pc), Need: need, Have: len(m.stack)}
+}
@@ -0,0 +1,218 @@
+package vm_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/svader0/yarnball/pkg/compiler"
+	"github.com/svader0/yarnball/pkg/evaluator"
+	"github.com/svader0/yarnball/pkg/parser"
+	"github.com/svader0/yarnball/pkg/vm"
+)
+
+// result is what a run of a pattern left behind.
+type result struct {
+	out   string
+	err   string
+	stack []int
+}
+
+func parse(t *testing.T, src string) *parser.Program {
+	t.Helper()
+	prog, err := parser.ParseFile(nil, "", src)
+	if err != nil {
+		t.Fatalf("parse %q: %v", src, err)
+	}
+	return prog
+}
+
+func runTree(t *testing.T, src string, steps int) result {
+	var out strings.Builder
+	ev := evaluator.New(nil, evaluator.WithOutput(&out), evaluator.WithInput(strings.NewReader("")), evaluator.WithStepLimit(steps))
+	err := ev.Eval(parse(t, src))
+	r := result{out: out.String()}
+	if err != nil {
+		r.err = err.Error()
+	}
+	if st := ev.Stack(); st != nil {
+		r.stack = st.Items()
+	}
+	return r
+}
+
+func runVM(t *testing.T, src string, steps int) result {
+	prog, err := compiler.Compile(parse(t, src))
+	if err != nil {
+		t.Fatalf("compile %q: %v", src, err)
+	}
+	var out strings.Builder
+	m := vm.New(prog, vm.WithOutput(&out), vm.WithInput(strings.NewReader("")), vm.WithStepLimit(steps))
+	err = m.Run(context.Background())
+	r := result{out: out.String(), stack: m.Stack()}
+	if err != nil {
+		r.err = err.Error()
+	}
+	return r
+}
+
+// TestEnginesAgree runs each pattern on the tree-walking evaluator and on the
+// vm, with a step limit large enough to finish and with every smaller one,
+// and checks that both print the same, fail the same way and leave the same
+// stack.
+func TestEnginesAgree(t *testing.T) {
+	patterns := []string{
+		"ch 1 ch 2 bob yo",
+		"ch 5 ch 0 tr",
+		"ch 1 pick 9223372036854775807",
+		"ch 1 roll 9223372036854775807",
+		"ch 1 ch 2 ch 3 roll 2 yo yo yo",
+		"ch 1 ch 2 pick 1 yo yo yo sc",
+		"stitch sq(n) = ( n n dc ) ch 7 sq yo ch 1 sq",
+		"ch 3 * tally yo * repeat from stack",
+		"ch 1 * dec * repeat while",
+		"ch 1 * * repeat while",
+		"ch 0 * * repeat until",
+		"ch 2 * ch 4 * repeat from stack",
+		"* ch 1 skip yo * repeat 3 ch 5",
+		"\"hi\" embroider sm nope",
+		"ch 4 wind ch 9 swap stash ch 4 unstash",
+		"ch 7 ch 5 try unstash rescue yo yo end",
+	}
+	for _, src := range patterns {
+		full := runTree(t, src, 10_000)
+		if got := runVM(t, src, 10_000); !equal(full, got) {
+			t.Errorf("%q:\n tree: %+v\n   vm: %+v", src, full, got)
+			continue
+		}
+		for limit := 1; limit <= 40; limit++ {
+			want, got := runTree(t, src, limit), runVM(t, src, limit)
+			if !equal(want, got) {
+				t.Errorf("%q with step limit %d:\n tree: %+v\n   vm: %+v", src, limit, want, got)
+				break
+			}
+		}
+	}
+}
+
+// TestEmptyLoopStops checks that a repeat with nothing in it still notices
+// the timeout, with a step limit too large to stop it first.
+func TestEmptyLoopStops(t *testing.T) {
+	for _, src := range []string{"ch 1 * * repeat while", "ch 0 * * repeat until"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		ev := evaluator.New(nil, evaluator.WithOutput(io.Discard), evaluator.WithStepLimit(math.MaxInt))
+		if err := ev.EvalContext(ctx, parse(t, src)); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%q on the tree: got %v, want the deadline", src, err)
+		}
+		prog, err := compiler.Compile(parse(t, src))
+		if err != nil {
+			t.Fatalf("compile %q: %v", src, err)
+		}
+		m := vm.New(prog, vm.WithOutput(io.Discard), vm.WithStepLimit(math.MaxInt))
+		if err := m.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%q on the vm: got %v, want the deadline", src, err)
+		}
+		cancel()
+	}
+}
+
+func equal(a, b result) bool {
+	return a.out == b.out && a.err == b.err && slices.Equal(a.stack, b.stack)
+}
+
+// TestSharedProgram runs one prepared program, and one compiled program, on
+// many goroutines at once, as a server would. Run it with -race.
+func TestSharedProgram(t *testing.T) {
+	const src = `
+stitch sq(n) = ( n n dc pm r sm r )
+ch 7 sq yo
+ch 2 wind sl st ch 5 swap stash unstash yo
+ch 9 pm total sm total yo
+stitch step = ( sl st ch 2 cl if ch 3 dc inc else ch 2 tr end )
+ch 100 * sl st sl st ch 1 neq [ sc step sl st ch 1 neq ] repeat while sc sc dec * repeat while yo
+`
+	const want = "49\n5\n9\n0\n"
+
+	ready, err := evaluator.Prepare(parse(t, src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := compiler.Compile(parse(t, src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	engines := map[string]func(out io.Writer) error{
+		"tree": func(out io.Writer) error {
+			return evaluator.New(nil, evaluator.WithOutput(out), evaluator.WithStepLimit(math.MaxInt)).Run(context.Background(), ready)
+		},
+		"vm": func(out io.Writer) error {
+			return vm.New(code, vm.WithOutput(out), vm.WithStepLimit(math.MaxInt)).Run(context.Background())
+		},
+	}
+	for name, run := range engines {
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var out strings.Builder
+				if err := run(&out); err != nil {
+					t.Errorf("%s: %v", name, err)
+				} else if out.String() != want {
+					t.Errorf("%s printed %q, want %q", name, out.String(), want)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// collatz follows the Collatz sequence from every number up to 2000 down to
+// 1: about two million steps of stitch calls, ifs and arithmetic.
+const collatz = `
+stitch step = ( sl st ch 2 cl if ch 3 dc inc else ch 2 tr end )
+ch 2000 * sl st sl st ch 1 neq [ sc step sl st ch 1 neq ] repeat while sc sc dec * repeat while
+`
+
+// BenchmarkCollatz compares the engines on a number-crunching pattern.
+func BenchmarkCollatz(b *testing.B) {
+	b.Run("tree", func(b *testing.B) {
+		ready, err := evaluator.Prepare(parseB(b, collatz))
+		if err != nil {
+			b.Fatal(err)
+		}
+		for range b.N {
+			ev := evaluator.New(nil, evaluator.WithOutput(io.Discard), evaluator.WithStepLimit(math.MaxInt))
+			if err := ev.Run(context.Background(), ready); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("vm", func(b *testing.B) {
+		code, err := compiler.Compile(parseB(b, collatz))
+		if err != nil {
+			b.Fatal(err)
+		}
+		for range b.N {
+			m := vm.New(code, vm.WithOutput(io.Discard), vm.WithStepLimit(math.MaxInt))
+			if err := m.Run(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func parseB(b *testing.B, src string) *parser.Program {
+	b.Helper()
+	prog, err := parser.ParseFile(nil, "", src)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return prog
+}